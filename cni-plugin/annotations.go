@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/util"
+	"github.com/linkerd/linkerd2-proxy-init/proxy-init/cmd"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The annotations overriding the plugin configuration, set either on the pod
+// or on its namespace.
+const (
+	annotationSkipInboundPorts            = "config.linkerd.io/skip-inbound-ports"
+	annotationSkipInboundPortsFromSubnets = "config.linkerd.io/skip-inbound-ports-from-subnets"
+	annotationSkipOutboundPorts           = "config.linkerd.io/skip-outbound-ports"
+	annotationSkipSubnets                 = "config.linkerd.io/skip-subnets"
+	annotationSkipOutboundSubnets         = "config.linkerd.io/skip-outbound-subnets"
+	annotationPortsToRedirect             = "config.linkerd.io/ports-to-redirect"
+	annotationInboundPort                 = "config.linkerd.io/inbound-port"
+	annotationOutboundPort                = "config.linkerd.io/outbound-port"
+	annotationIPTablesMode                = "config.linkerd.io/iptables-mode"
+	annotationEnableIPv6                  = "config.linkerd.io/enable-ipv6"
+	annotationProxyUID                    = "config.linkerd.io/proxy-uid"
+	annotationProxyGID                    = "config.linkerd.io/proxy-gid"
+	annotationProxyMark                   = "config.linkerd.io/proxy-mark"
+	annotationProxyOutboundDNSPort        = "config.linkerd.io/proxy-outbound-dns-port"
+)
+
+// annotationOverrides holds the configuration overridden by the
+// annotations. The fields of the annotations that aren't set are left nil or
+// empty.
+type annotationOverrides struct {
+	IncomingProxyPort               *int
+	OutgoingProxyPort               *int
+	InboundPortsToIgnore            []string
+	InboundPortsToIgnoreFromSubnets []string
+	OutboundPortsToIgnore           []string
+	SubnetsToIgnore                 []string
+	OutboundSubnetsToIgnore         []string
+	// PortsToRedirect may hold named ports, resolved against the pod's
+	// containers.
+	PortsToRedirect      []string
+	ProxyUID             *int
+	ProxyGID             *int
+	ProxyMark            *int
+	OutboundDNSProxyPort *int
+	IPTablesMode         string
+	IPv6                 *bool
+}
+
+// annotationResolver looks up the annotations of a pod, falling back to the
+// ones of its namespace. Both are loaded once, when the resolver is created.
+type annotationResolver struct {
+	pod       map[string]string
+	namespace map[string]string
+}
+
+// newAnnotationResolver returns the resolver of the pod's annotations,
+// fetching its namespace.
+func newAnnotationResolver(ctx context.Context, meta podMetadata, pod *v1.Pod) (*annotationResolver, error) {
+	ns, err := meta.getNamespace(ctx, pod.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+
+	return &annotationResolver{pod: pod.GetAnnotations(), namespace: ns.GetAnnotations()}, nil
+}
+
+// get returns the value of the annotation, set on the pod or else on the
+// namespace.
+func (r *annotationResolver) get(key string) string {
+	if value := r.pod[key]; value != "" {
+		return value
+	}
+
+	return r.namespace[key]
+}
+
+// overrides parses all the annotations in a single pass. Every annotation
+// that can't be parsed is reported.
+func (r *annotationResolver) overrides() (*annotationOverrides, error) {
+	o := &annotationOverrides{
+		InboundPortsToIgnore:            r.list(annotationSkipInboundPorts),
+		InboundPortsToIgnoreFromSubnets: r.list(annotationSkipInboundPortsFromSubnets),
+		OutboundPortsToIgnore:           r.list(annotationSkipOutboundPorts),
+		SubnetsToIgnore:                 r.list(annotationSkipSubnets),
+		OutboundSubnetsToIgnore:         r.list(annotationSkipOutboundSubnets),
+		PortsToRedirect:                 r.list(annotationPortsToRedirect),
+		IPTablesMode:                    r.get(annotationIPTablesMode),
+	}
+
+	errs := []error{}
+	var err error
+	o.IncomingProxyPort, err = r.integer(annotationInboundPort, util.ParseProxyPort)
+	errs = append(errs, err)
+	o.OutgoingProxyPort, err = r.integer(annotationOutboundPort, util.ParseProxyPort)
+	errs = append(errs, err)
+	o.ProxyUID, err = r.integer(annotationProxyUID, strconv.Atoi)
+	errs = append(errs, err)
+	o.ProxyGID, err = r.integer(annotationProxyGID, strconv.Atoi)
+	errs = append(errs, err)
+	o.ProxyMark, err = r.integer(annotationProxyMark, func(value string) (int, error) {
+		// accept hexadecimal marks, as usually written
+		parsed, err := strconv.ParseUint(value, 0, 32)
+		return int(parsed), err
+	})
+	errs = append(errs, err)
+	o.OutboundDNSProxyPort, err = r.integer(annotationProxyOutboundDNSPort, util.ParsePort)
+	errs = append(errs, err)
+
+	switch o.IPTablesMode {
+	case "", cmd.IPTablesModeLegacy, cmd.IPTablesModeNFT, cmd.IPTablesModePlain, cmd.IPTablesModeNFTables:
+	default:
+		errs = append(errs, fmt.Errorf("%s: invalid value %q: valid values are only %q, %q, %q and %q", annotationIPTablesMode, o.IPTablesMode, cmd.IPTablesModeLegacy, cmd.IPTablesModeNFT, cmd.IPTablesModePlain, cmd.IPTablesModeNFTables))
+	}
+
+	if value := r.get(annotationEnableIPv6); value != "" {
+		ipv6, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q: %w", annotationEnableIPv6, value, err))
+		} else {
+			o.IPv6 = &ipv6
+		}
+	}
+
+	return o, errors.Join(errs...)
+}
+
+// list returns the comma separated values of the annotation, or nil when it
+// isn't set.
+func (r *annotationResolver) list(key string) []string {
+	value := r.get(key)
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// integer returns the value of the annotation parsed by parse, or nil when it
+// isn't set.
+func (r *annotationResolver) integer(key string, parse func(string) (int, error)) (*int, error) {
+	value := r.get(key)
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid value %q: %w", key, value, err)
+	}
+
+	return &parsed, nil
+}
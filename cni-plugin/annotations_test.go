@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPod(annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "emojivoto", Annotations: annotations},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "web",
+				Ports: []v1.ContainerPort{{Name: "admin-http", ContainerPort: 9990}},
+			}},
+		},
+	}
+}
+
+func newTestNamespace(annotations map[string]string) *v1.Namespace {
+	return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "emojivoto", Annotations: annotations}}
+}
+
+func TestAnnotationResolver(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(map[string]string{
+		annotationSkipSubnets:      "10.0.0.0/8",
+		annotationProxyUID:         "1000",
+		annotationSkipInboundPorts: "25",
+	}))
+	pod := newTestPod(map[string]string{
+		annotationSkipInboundPorts:  "4190,admin-http",
+		annotationProxyMark:         "0x2a",
+		annotationSkipOutboundPorts: "",
+	})
+
+	resolver, err := newAnnotationResolver(context.Background(), &apiMetadata{client: client}, pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	actual, err := resolver.overrides()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	uid, mark := 1000, 0x2a
+	expected := &annotationOverrides{
+		InboundPortsToIgnore: []string{"4190", "admin-http"},
+		SubnetsToIgnore:      []string{"10.0.0.0/8"},
+		ProxyUID:             &uid,
+		ProxyMark:            &mark,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected overrides %+v but got %+v", expected, actual)
+	}
+
+	gets := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "namespaces" {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Fatalf("expected the namespace to be fetched once, got %d", gets)
+	}
+}
+
+func TestAnnotationResolver_Errors(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(map[string]string{
+		annotationProxyGID: "proxy",
+	}))
+	pod := newTestPod(map[string]string{
+		annotationProxyMark:            "0x100000000",
+		annotationProxyOutboundDNSPort: "70000",
+		annotationInboundPort:          "-1",
+		annotationOutboundPort:         "0",
+		annotationIPTablesMode:         "ebpf",
+		annotationEnableIPv6:           "maybe",
+	})
+
+	resolver, err := newAnnotationResolver(context.Background(), &apiMetadata{client: client}, pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = resolver.overrides()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, annotation := range []string{annotationProxyGID, annotationProxyMark, annotationProxyOutboundDNSPort, annotationInboundPort, annotationOutboundPort, annotationIPTablesMode, annotationEnableIPv6} {
+		if !strings.Contains(err.Error(), annotation+": invalid value") {
+			t.Errorf("expected the error to report %s, got %s", annotation, err)
+		}
+	}
+}
+
+func TestAnnotationResolver_MissingNamespace(t *testing.T) {
+	_, err := newAnnotationResolver(context.Background(), &apiMetadata{client: fake.NewClientset()}, newTestPod(nil))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(map[string]string{
+		annotationSkipOutboundSubnets: "169.254.169.254/32",
+	}))
+	pod := newTestPod(map[string]string{
+		annotationSkipInboundPorts: "admin-http",
+		annotationPortsToRedirect:  "8080,admin-http",
+		annotationProxyUID:         "2102",
+		annotationInboundPort:      "5143",
+		annotationOutboundPort:     "5140",
+		annotationIPTablesMode:     "nftables",
+		annotationEnableIPv6:       "true",
+	})
+	conf := &PluginConf{ProxyInit: ProxyInit{
+		IncomingProxyPort:    4143,
+		OutgoingProxyPort:    4140,
+		InboundPortsToIgnore: []string{"4190", "4191"},
+	}}
+
+	options, err := buildOptions(context.Background(), &apiMetadata{client: client}, pod, conf, "/var/run/netns/pod", logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(options.InboundPortsToIgnore, []string{"4190", "4191", "9990"}) {
+		t.Errorf("unexpected InboundPortsToIgnore %v", options.InboundPortsToIgnore)
+	}
+	if !reflect.DeepEqual(options.PortsToRedirect, []int{8080, 9990}) {
+		t.Errorf("unexpected PortsToRedirect %v", options.PortsToRedirect)
+	}
+	if !reflect.DeepEqual(options.OutboundSubnetsToIgnore, []string{"169.254.169.254/32"}) {
+		t.Errorf("unexpected OutboundSubnetsToIgnore %v", options.OutboundSubnetsToIgnore)
+	}
+	if options.ProxyUserID != 2102 || options.NetNs != "/var/run/netns/pod" {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if options.IncomingProxyPort != 5143 || options.OutgoingProxyPort != 5140 || options.IPTablesMode != "nftables" || !options.IPv6 {
+		t.Errorf("expected the proxy ports, mode and IPv6 to be overridden, got %+v", options)
+	}
+}
+
+func TestBuildOptions_InvalidAnnotations(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(nil))
+	conf := &PluginConf{ProxyInit: ProxyInit{IncomingProxyPort: 4143, OutgoingProxyPort: 4140}}
+	for _, annotations := range []map[string]string{
+		{annotationOutboundPort: "notanumber"},
+		{annotationSkipInboundPorts: "missing-port"},
+		{annotationSkipSubnets: "fd00::/8", annotationEnableIPv6: "false"},
+	} {
+		_, err := buildOptions(context.Background(), &apiMetadata{client: client}, newTestPod(annotations), conf, "", logrus.NewEntry(logrus.StandardLogger()))
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != errCodeInvalidOptions {
+			t.Errorf("expected a CNI error with code %d for %v, got %v", errCodeInvalidOptions, annotations, err)
+		}
+	}
+}
+
+func TestBuildOptions_CgroupPathUnsupported(t *testing.T) {
+	conf := &PluginConf{ProxyInit: ProxyInit{IncomingProxyPort: 4143, OutgoingProxyPort: 4140, ProxyCgroupPath: "kubepods/pod1234/proxy"}}
+	_, err := buildOptions(context.Background(), &apiMetadata{client: fake.NewClientset(newTestNamespace(nil))}, newTestPod(nil), conf, "", logrus.NewEntry(logrus.StandardLogger()))
+
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != types.ErrInvalidNetworkConfig || !strings.Contains(cniErr.Details, "proxy-mark") {
+		t.Fatalf("expected an invalid network config error pointing to proxy-mark, got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/linkerd/linkerd2-proxy-init/proxy-init/cmd"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestCmdCheck(t *testing.T) {
+	conf := &PluginConf{ProxyInit: ProxyInit{
+		IncomingProxyPort:    4143,
+		OutgoingProxyPort:    4140,
+		InboundPortsToIgnore: []string{"4190", "4191"},
+		IPTablesMode:         cmd.IPTablesModeLegacy,
+	}}
+
+	t.Run("matching rules", func(t *testing.T) {
+		p, _ := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+		args := newTestArgs(t, conf)
+
+		if err := p.cmdAdd(args); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := p.cmdCheck(args); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		p, backend := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+		args := newTestArgs(t, conf)
+
+		if err := p.cmdAdd(args); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the rule ignoring 4190 and 4191 has been removed by hand
+		backend.Tables["nat"]["PROXY_INIT_REDIRECT"] = backend.Tables["nat"]["PROXY_INIT_REDIRECT"][1:]
+
+		err := p.cmdCheck(args)
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != errCodeFirewallDrift {
+			t.Fatalf("expected a CNI error with code %d, got %v", errCodeFirewallDrift, err)
+		}
+	})
+
+	t.Run("wrong rules, nftables", func(t *testing.T) {
+		p, _ := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+		installed := &PluginConf{ProxyInit: ProxyInit{
+			IncomingProxyPort: 4143,
+			OutgoingProxyPort: 4140,
+			ProxyUID:          2102,
+			IPTablesMode:      cmd.IPTablesModeNFTables,
+		}}
+		if err := p.cmdAdd(newTestArgs(t, installed)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := p.cmdCheck(newTestArgs(t, installed)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// the rules have the same comments but redirect to stale proxy
+		// ports, ignoring a stale UID
+		expected := &PluginConf{ProxyInit: installed.ProxyInit}
+		expected.ProxyInit.IncomingProxyPort = 9999
+		expected.ProxyInit.OutgoingProxyPort = 9998
+		expected.ProxyInit.ProxyUID = 1
+		err := p.cmdCheck(newTestArgs(t, expected))
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != errCodeFirewallDrift {
+			t.Fatalf("expected a CNI error with code %d, got %v", errCodeFirewallDrift, err)
+		}
+		for _, rule := range []string{"--to-ports 9999", "--to-ports 9998", "--uid-owner 1 "} {
+			if !strings.Contains(cniErr.Details, "missing rule in chain PROXY_INIT_") || !strings.Contains(cniErr.Details, rule) {
+				t.Errorf("expected the rule with %q to be reported missing, got %s", rule, cniErr.Details)
+			}
+		}
+	})
+
+	t.Run("verification failure", func(t *testing.T) {
+		p, backend := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+		backend.VerifyErr = errors.New("iptables-save: exit status 1")
+
+		err := p.cmdCheck(newTestArgs(t, conf))
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != types.ErrInternal {
+			t.Fatalf("expected a CNI error with code %d, got %v", types.ErrInternal, err)
+		}
+	})
+
+	optedOut := newTestPod(map[string]string{"linkerd.io/inject": "disabled"})
+	withInit := newMeshedTestPod(nil)
+	withInit.Spec.InitContainers = append(withInit.Spec.InitContainers, v1.Container{Name: "linkerd-init"})
+
+	for _, tc := range []struct {
+		name string
+		pod  *v1.Pod
+		// mutate adjusts the arguments of the request
+		mutate func(args *skel.CmdArgs)
+	}{
+		{name: "no proxy", pod: newTestPod(nil)},
+		{name: "opted-out pod", pod: optedOut},
+		{name: "linkerd-init present", pod: withInit},
+		{
+			name:   "no Kubernetes arguments",
+			pod:    newMeshedTestPod(nil),
+			mutate: func(args *skel.CmdArgs) { args.Args = "" },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the firewall of the pod isn't looked at, and would report drift
+			// otherwise
+			p, backend := newTestPlugin(newTestNamespace(nil), tc.pod)
+			backend.VerifyErr = errors.New("unexpected verification")
+
+			args := newTestArgs(t, conf)
+			if tc.mutate != nil {
+				tc.mutate(args)
+			}
+
+			if err := p.cmdCheck(args); err != nil {
+				t.Fatalf("expected the pod to be skipped, got %s", err)
+			}
+		})
+	}
+}
+
+func TestInvalidFirewallOptions(t *testing.T) {
+	p, _ := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+	args := newTestArgs(t, &PluginConf{ProxyInit: ProxyInit{
+		IncomingProxyPort: 70000,
+		OutgoingProxyPort: 4140,
+		IPTablesMode:      cmd.IPTablesModeLegacy,
+	}})
+
+	for name, fn := range map[string]func(*skel.CmdArgs) error{"ADD": p.cmdAdd, "CHECK": p.cmdCheck} {
+		err := fn(args)
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != errCodeInvalidOptions {
+			t.Errorf("expected %s to fail with a CNI error with code %d, got %v", name, errCodeInvalidOptions, err)
+		}
+	}
+}
+
+func TestMissingIPSet(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		expected uint
+	}{
+		{mode: cmd.IPTablesModeLegacy, expected: errCodeInvalidOptions},
+		{mode: cmd.IPTablesModeNFT, expected: errCodeInvalidOptions},
+		// the nftables sets need no binary
+		{mode: cmd.IPTablesModeNFTables},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			p, backend := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(nil))
+			p.lookPath = func(file string) (string, error) {
+				return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+			}
+			args := newTestArgs(t, &PluginConf{ProxyInit: ProxyInit{
+				IncomingProxyPort: 4143,
+				OutgoingProxyPort: 4140,
+				SubnetsToIgnore:   []string{"10.0.0.0/8"},
+				UseSets:           true,
+				IPTablesMode:      tc.mode,
+			}})
+
+			err := p.cmdAdd(args)
+			if tc.expected == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			var cniErr *types.Error
+			if !errors.As(err, &cniErr) || cniErr.Code != tc.expected {
+				t.Fatalf("expected a CNI error with code %d, got %v", tc.expected, err)
+			}
+			if len(backend.Tables) != 0 || len(backend.Sets) != 0 {
+				t.Errorf("expected no rules to be installed, got tables %v and sets %v", backend.Tables, backend.Sets)
+			}
+		})
+	}
+}
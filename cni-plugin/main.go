@@ -21,8 +21,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 
@@ -35,26 +37,59 @@ import (
 
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// ProxyInit is the configuration for the proxy-init binary
+// errCodeFirewallDrift is the CNI error code returned by CHECK when the pod's
+// firewall rules differ from the expected ones. Codes starting at 100 are
+// reserved for plugin specific errors.
+const errCodeFirewallDrift uint = 100
+
+// errCodeInvalidOptions is the CNI error code returned when the options
+// built from the plugin configuration and the pod annotations are invalid.
+const errCodeInvalidOptions uint = 101
+
+// plugin holds the dependencies of the CNI commands.
+type plugin struct {
+	// newMetadata returns the source of the pod and namespace metadata.
+	newMetadata func(conf *PluginConf) podMetadata
+	// backend, when set, replaces the backend the firewall is configured
+	// with.
+	backend iptables.Backend
+	// lookPath finds the binaries the iptables backends run on the host.
+	lookPath func(file string) (string, error)
+}
+
+// ProxyInit is the configuration for the proxy-init binary. Its fields are
+// named after the proxy-init flags, so it can also be passed to proxy-init
+// through --config.
 type ProxyInit struct {
-	IncomingProxyPort     int      `json:"incoming-proxy-port"`
-	OutgoingProxyPort     int      `json:"outgoing-proxy-port"`
-	ProxyUID              int      `json:"proxy-uid"`
-	ProxyGID              int      `json:"proxy-gid"`
-	PortsToRedirect       []int    `json:"ports-to-redirect"`
-	InboundPortsToIgnore  []string `json:"inbound-ports-to-ignore"`
-	OutboundPortsToIgnore []string `json:"outbound-ports-to-ignore"`
-	SubnetsToIgnore       []string `json:"subnets-to-ignore"`
-	Simulate              bool     `json:"simulate"`
-	UseWaitFlag           bool     `json:"use-wait-flag"`
-	IPTablesMode          string   `json:"iptables-mode"`
-	IPv6                  bool     `json:"ipv6"`
+	IncomingProxyPort               int      `json:"incoming-proxy-port"`
+	OutgoingProxyPort               int      `json:"outgoing-proxy-port"`
+	ProxyUID                        int      `json:"proxy-uid"`
+	ProxyGID                        int      `json:"proxy-gid"`
+	ProxyCgroupPath                 string   `json:"proxy-cgroup-path"`
+	ProxyMark                       int      `json:"proxy-mark"`
+	PortsToRedirect                 []int    `json:"ports-to-redirect"`
+	InboundPortsToIgnore            []string `json:"inbound-ports-to-ignore"`
+	InboundPortsToIgnoreFromSubnets []string `json:"inbound-ports-to-ignore-from-subnets"`
+	OutboundPortsToIgnore           []string `json:"outbound-ports-to-ignore"`
+	SubnetsToIgnore                 []string `json:"subnets-to-ignore"`
+	OutboundSubnetsToIgnore         []string `json:"outbound-subnets-to-ignore"`
+	UseSets                         bool     `json:"use-sets"`
+	LenientPortValidation           bool     `json:"lenient-port-validation"`
+	Simulate                        bool     `json:"simulate"`
+	UseWaitFlag                     bool     `json:"use-wait-flag"`
+	IPTablesMode                    string   `json:"iptables-mode"`
+	IPv6                            bool     `json:"ipv6"`
+	OutboundDNSProxyPort            int      `json:"outbound-dns-proxy-port"`
+
+	// MergePolicy sets, per field, whether the entries of the annotations
+	// are appended to the configured ones or replace them. See
+	// defaultMergePolicies for the fields and their default policy.
+	MergePolicy map[string]string `json:"merge-policy"`
 }
 
 // Kubernetes a K8s specific struct to hold config
@@ -80,19 +115,26 @@ type PluginConf struct {
 	RawPrevResult *map[string]interface{} `json:"prevResult"`
 	PrevResult    *cniv1.Result           `json:"-"`
 
-	LogLevel   string     `json:"log_level"`
-	ProxyInit  ProxyInit  `json:"linkerd"`
-	Kubernetes Kubernetes `json:"kubernetes"`
+	LogLevel string `json:"log_level"`
+	// StateDir, when set, is where the options applied to each container are
+	// recorded, to be removed on DEL.
+	StateDir string `json:"state_dir"`
+	// MetadataCacheSocket, when set, is the socket of the metadata cache
+	// served by linkerd-cni, consulted before the API server.
+	MetadataCacheSocket string     `json:"metadata_cache_socket"`
+	ProxyInit           ProxyInit  `json:"linkerd"`
+	Kubernetes          Kubernetes `json:"kubernetes"`
 }
 
 func main() {
 	// Must log to Stderr because the CNI runtime uses Stdout as its state
 	logrus.SetOutput(os.Stderr)
+	p := &plugin{newMetadata: newPodMetadata, lookPath: exec.LookPath}
 	skel.PluginMainFuncs(
 		skel.CNIFuncs{
-			Add:   cmdAdd,
-			Check: cmdCheck,
-			Del:   cmdDel,
+			Add:   p.cmdAdd,
+			Check: p.cmdCheck,
+			Del:   p.cmdDel,
 		},
 		version.All,
 		"",
@@ -143,7 +185,7 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 }
 
 // cmdAdd is called by the CNI runtime for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
+func (p *plugin) cmdAdd(args *skel.CmdArgs) error {
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
 		logrus.Errorf("error parsing config: %e", err)
@@ -164,10 +206,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// Determine if running under k8s by checking the CNI args
-	k8sArgs := K8sArgs{}
-	args.Args = strings.Replace(args.Args, "K8S_POD_NAMESPACE", "K8sPodNamespace", 1)
-	args.Args = strings.Replace(args.Args, "K8S_POD_NAME", "K8sPodName", 1)
-	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+	k8sArgs, err := loadK8sArgs(args)
+	if err != nil {
 		logrus.Errorf("error loading args %e", err)
 		return err
 	}
@@ -183,156 +223,33 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if namespace != "" && podName != "" {
 		ctx := context.Background()
 
-		configLoadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: conf.Kubernetes.Kubeconfig}
-		configOverrides := &clientcmd.ConfigOverrides{CurrentContext: "linkerd-cni-context"}
-
-		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(configLoadingRules, configOverrides).ClientConfig()
-		if err != nil {
-			logrus.Errorf("linkerd-cni client err with NewNonInteractiveDeferredLoadingClientConfig: %e", err)
-			return err
-		}
-
-		client, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			logrus.Errorf("linkerd-cni client err with NewForConfig: %e", err)
-			return err
-		}
+		meta := p.newMetadata(conf)
 
-		pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		pod, err := meta.getPod(ctx, namespace, podName)
 		if err != nil {
 			logrus.Errorf("linkerd-cni client err in client.Pods().Get(): %e", err)
 			return err
 		}
 
-		containsInitContainer := false
-		for _, container := range pod.Spec.InitContainers {
-			if container.Name == "linkerd-init" {
-				containsInitContainer = true
-				break
-			}
-		}
+		containsInitContainer := containsLinkerdInit(&pod.Spec)
 
 		if !containsInitContainer && containsLinkerdProxy(&pod.Spec) {
 			logEntry.Debugf("linkerd-cni: setting up iptables firewall for %s/%s", namespace, pod)
-			options := cmd.RootOptions{
-				IncomingProxyPort:     conf.ProxyInit.IncomingProxyPort,
-				OutgoingProxyPort:     conf.ProxyInit.OutgoingProxyPort,
-				ProxyUserID:           conf.ProxyInit.ProxyUID,
-				ProxyGroupID:          conf.ProxyInit.ProxyGID,
-				PortsToRedirect:       conf.ProxyInit.PortsToRedirect,
-				InboundPortsToIgnore:  conf.ProxyInit.InboundPortsToIgnore,
-				OutboundPortsToIgnore: conf.ProxyInit.OutboundPortsToIgnore,
-				SubnetsToIgnore:       conf.ProxyInit.SubnetsToIgnore,
-				SimulateOnly:          conf.ProxyInit.Simulate,
-				NetNs:                 args.Netns,
-				UseWaitFlag:           conf.ProxyInit.UseWaitFlag,
-				IPTablesMode:          conf.ProxyInit.IPTablesMode,
-				IPv6:                  conf.ProxyInit.IPv6,
-			}
-
-			// Check if there are any overridden ports to be skipped
-			outboundSkipOverride, err := getAnnotationOverride(ctx, client, pod, "config.linkerd.io/skip-outbound-ports")
+			options, err := buildOptions(ctx, meta, pod, conf, args.Netns, logEntry)
 			if err != nil {
-				logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
 				return err
 			}
 
-			if outboundSkipOverride != "" {
-				logEntry.Debugf("linkerd-cni: overriding OutboundPortsToIgnore to %s", outboundSkipOverride)
-				options.OutboundPortsToIgnore = strings.Split(outboundSkipOverride, ",")
-			}
-
-			inboundSkipOverride, err := getAnnotationOverride(ctx, client, pod, "config.linkerd.io/skip-inbound-ports")
-			if err != nil {
-				logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
-				return err
-			}
-
-			if inboundSkipOverride != "" {
-				logEntry.Debugf("linkerd-cni: overriding InboundPortsToIgnore to %s", inboundSkipOverride)
-				options.InboundPortsToIgnore = append(options.InboundPortsToIgnore, strings.Split(inboundSkipOverride, ",")...)
-			}
-
-			// Check if there are any subnets to skip
-			subnetSkipOverride, err := getAnnotationOverride(ctx, client, pod, "config.linkerd.io/skip-subnets")
-			if err != nil {
-				logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
-				return err
-			}
-
-			if subnetSkipOverride != "" {
-				logEntry.Debugf("linkerd-cni: overriding SubnetsToIgnore to %s", subnetSkipOverride)
-				options.SubnetsToIgnore = strings.Split(subnetSkipOverride, ",")
-			}
-
-			// Override ProxyUID from annotations.
-			proxyUIDOverride, err := getAnnotationOverride(ctx, client, pod, "config.linkerd.io/proxy-uid")
-			if err != nil {
-				logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
+			if err := forEachIPFamily(options, func(opts *cmd.RootOptions) error {
+				return p.buildAndConfigure(logEntry, opts)
+			}); err != nil {
 				return err
 			}
 
-			if proxyUIDOverride != "" {
-				logEntry.Debugf("linkerd-cni: overriding ProxyUID to %s", proxyUIDOverride)
-
-				parsed, err := strconv.Atoi(proxyUIDOverride)
-				if err != nil {
-					logEntry.Errorf("linkerd-cni: could not parse ProxyUID to integer: %s", err)
-					return err
-				}
-
-				options.ProxyUserID = parsed
-			}
-
-			// Override ProxyGID from annotations.
-			proxyGIDOverride, err := getAnnotationOverride(ctx, client, pod, "config.linkerd.io/proxy-gid")
-			if err != nil {
-				logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
-				return err
-			}
-
-			if proxyGIDOverride != "" {
-				logEntry.Debugf("linkerd-cni: overriding ProxyGID to %s", proxyGIDOverride)
-
-				parsed, err := strconv.Atoi(proxyGIDOverride)
-				if err != nil {
-					logEntry.Errorf("linkerd-cni: could not parse ProxyGID to integer: %s", err)
-					return err
-				}
-
-				options.ProxyGroupID = parsed
-			}
-
-			if pod.GetLabels()["linkerd.io/control-plane-component"] != "" {
-				// Skip k8s api server ports on the outbound side if pod is a
-				// control plane component
-				skippedPorts, err := getAPIServerPorts(ctx, client)
-				if err != nil {
-					// If we cannot retrieve the 'kubernetes' service's ports (for
-					// whatever reason), skip default ports: 443, 6443
-					logEntry.Errorf("linkerd-cni: could not retrieve ports from 'kubernetes' service: %v", err)
-					skippedPorts = []string{"443", "6443"}
-				}
-
-				logEntry.Debugf("linkerd-cni: adding %v to OutboundPortsToIgnore as its a control plane component", skippedPorts)
-				options.OutboundPortsToIgnore = append(options.OutboundPortsToIgnore, skippedPorts...)
-			}
-
-			// This ensures BC against linkerd2-cni older versions not yet passing this flag
-			if options.IPTablesMode == "" {
-				options.IPTablesMode = cmd.IPTablesModeLegacy
-			}
-
-			// always trigger the IPv4 rules
-			optIPv4 := options
-			optIPv4.IPv6 = false
-			if err := buildAndConfigure(logEntry, &optIPv4); err != nil {
-				return err
-			}
-
-			// trigger the IPv6 rules
-			if options.IPv6 {
-				if err := buildAndConfigure(logEntry, &options); err != nil {
+			if conf.StateDir != "" {
+				state := &PodState{Namespace: namespace, Pod: podName, Netns: args.Netns, Options: *options}
+				if err := writeState(conf.StateDir, args.ContainerID, state); err != nil {
+					logEntry.Errorf("linkerd-cni: %s", err)
 					return err
 				}
 			}
@@ -358,17 +275,407 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(&cniv1.Result{CNIVersion: cniv1.ImplementedSpecVersion}, conf.CNIVersion)
 }
 
-func cmdCheck(_ *skel.CmdArgs) error {
-	logrus.Info("linkerd-cni: check called but not implemented")
+// cmdCheck is called for CHECK requests. The firewall rules expected for the
+// pod are recomputed from the plugin configuration and annotations, and
+// compared against the ones installed in its network namespace.
+func (p *plugin) cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		logrus.Errorf("error parsing config: %e", err)
+		return err
+	}
+	configureLogging(conf)
+
+	k8sArgs, err := loadK8sArgs(args)
+	if err != nil {
+		logrus.Errorf("error loading args %e", err)
+		return err
+	}
+
+	namespace := string(k8sArgs.K8sPodNamespace)
+	podName := string(k8sArgs.K8sPodName)
+	logEntry := logrus.WithFields(logrus.Fields{
+		"ContainerID": args.ContainerID,
+		"Pod":         podName,
+		"Namespace":   namespace,
+	})
+
+	if namespace == "" || podName == "" {
+		logEntry.Debug("linkerd-cni: no Kubernetes namespace or pod name found, skipping.")
+		return nil
+	}
+
+	ctx := context.Background()
+
+	meta := p.newMetadata(conf)
+
+	pod, err := meta.getPod(ctx, namespace, podName)
+	if err != nil {
+		logrus.Errorf("linkerd-cni client err in client.Pods().Get(): %e", err)
+		return err
+	}
+
+	if containsLinkerdInit(&pod.Spec) || !containsLinkerdProxy(&pod.Spec) {
+		logEntry.Debug("linkerd-cni: pod firewall is not managed by linkerd-cni, skipping.")
+		return nil
+	}
+
+	options, err := buildOptions(ctx, meta, pod, conf, args.Netns, logEntry)
+	if err != nil {
+		return err
+	}
+
+	logEntry.Debugf("linkerd-cni: checking iptables firewall for %s/%s", namespace, podName)
+	drifts := make([]string, 0)
+	if err := forEachIPFamily(options, func(opts *cmd.RootOptions) error {
+		found, err := p.buildAndVerify(logEntry, opts)
+		for _, drift := range found {
+			drifts = append(drifts, drift.String())
+		}
+		return err
+	}); err != nil {
+		var cniErr *types.Error
+		if errors.As(err, &cniErr) {
+			return err
+		}
+		return types.NewError(types.ErrInternal, "linkerd-cni: could not verify firewall", err.Error())
+	}
+
+	if len(drifts) > 0 {
+		for _, drift := range drifts {
+			logEntry.Errorf("linkerd-cni: %s", drift)
+		}
+		return types.NewError(errCodeFirewallDrift, "linkerd-cni: firewall rules do not match the expected configuration", strings.Join(drifts, "; "))
+	}
+
+	logrus.Debug("linkerd-cni: plugin is finished")
 	return nil
 }
 
-// cmdDel is called for DELETE requests
-func cmdDel(_ *skel.CmdArgs) error {
-	logrus.Info("linkerd-cni: delete called but not implemented")
+// cmdDel is called for DELETE requests. The rules are removed when the
+// network namespace still exists, and any state recorded for the container is
+// garbage-collected. Since DEL can be called multiple times for the same
+// container, anything already removed is skipped, and failing to remove the
+// rules doesn't fail the request.
+func (p *plugin) cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		logrus.Errorf("error parsing config: %e", err)
+		return err
+	}
+	configureLogging(conf)
+
+	logEntry := logrus.WithFields(logrus.Fields{
+		"ContainerID": args.ContainerID,
+	})
+
+	// an unreadable state, like one truncated by a node crash, is dropped
+	// along with the valid ones below, and the cleanup falls back to the
+	// options rebuilt without it
+	var state *PodState
+	unreadableState := false
+	if conf.StateDir != "" {
+		state, err = readState(conf.StateDir, args.ContainerID)
+		if err != nil {
+			logEntry.Errorf("linkerd-cni: %s, removing it", err)
+			unreadableState = true
+		}
+	}
+
+	if args.Netns == "" {
+		logEntry.Debug("linkerd-cni: no network namespace provided, skipping firewall cleanup.")
+	} else if _, err := os.Stat(args.Netns); err != nil {
+		logEntry.Debugf("linkerd-cni: network namespace %s is gone, skipping firewall cleanup.", args.Netns)
+	} else if state == nil && conf.StateDir != "" && !unreadableState {
+		logEntry.Debug("linkerd-cni: no state recorded for the container, skipping firewall cleanup.")
+	} else {
+		var options *cmd.RootOptions
+		if state != nil {
+			logEntry = logEntry.WithFields(logrus.Fields{"Pod": state.Pod, "Namespace": state.Namespace})
+			options = &state.Options
+		} else {
+			options = cleanupOptions(context.Background(), p.newMetadata(conf), args, conf, logEntry)
+		}
+		options.NetNs = args.Netns
+
+		// This ensures BC against linkerd2-cni older versions not yet passing this flag
+		if options.IPTablesMode == "" {
+			options.IPTablesMode = cmd.IPTablesModeLegacy
+		}
+
+		logEntry.Debugf("linkerd-cni: cleaning up iptables firewall in %s", args.Netns)
+		// The rules go away along with the network namespace anyway, while
+		// failing would have the runtime retry DEL forever on a namespace
+		// already partly torn down, so errors are only logged.
+		_ = forEachIPFamily(options, func(opts *cmd.RootOptions) error {
+			if err := p.buildAndCleanup(logEntry, opts); err != nil {
+				logEntry.Warnf("linkerd-cni: could not clean up firewall, continuing: %s", err)
+			}
+			return nil
+		})
+	}
+
+	if conf.StateDir != "" {
+		if err := removeState(conf.StateDir, args.ContainerID); err != nil {
+			logEntry.Errorf("linkerd-cni: %s", err)
+			return err
+		}
+	}
+
+	logrus.Debug("linkerd-cni: plugin is finished")
 	return nil
 }
 
+// loadK8sArgs parses the Kubernetes specific CNI_ARGS.
+func loadK8sArgs(args *skel.CmdArgs) (*K8sArgs, error) {
+	k8sArgs := K8sArgs{}
+	cniArgs := strings.Replace(args.Args, "K8S_POD_NAMESPACE", "K8sPodNamespace", 1)
+	cniArgs = strings.Replace(cniArgs, "K8S_POD_NAME", "K8sPodName", 1)
+	if err := types.LoadArgs(cniArgs, &k8sArgs); err != nil {
+		return nil, err
+	}
+	return &k8sArgs, nil
+}
+
+func newKubernetesClient(conf *PluginConf) (*kubernetes.Clientset, error) {
+	configLoadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: conf.Kubernetes.Kubeconfig}
+	configOverrides := &clientcmd.ConfigOverrides{CurrentContext: "linkerd-cni-context"}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(configLoadingRules, configOverrides).ClientConfig()
+	if err != nil {
+		logrus.Errorf("linkerd-cni client err with NewNonInteractiveDeferredLoadingClientConfig: %e", err)
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logrus.Errorf("linkerd-cni client err with NewForConfig: %e", err)
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// cleanupOptions returns the options to clean up the firewall of a container
+// for which no state was recorded. They are rebuilt like on ADD when the pod
+// can still be fetched, so that the overrides of its annotations apply, and
+// from the plugin configuration alone otherwise.
+func cleanupOptions(ctx context.Context, meta podMetadata, args *skel.CmdArgs, conf *PluginConf, logEntry *logrus.Entry) *cmd.RootOptions {
+	k8sArgs, err := loadK8sArgs(args)
+	if err == nil && k8sArgs.K8sPodNamespace != "" && k8sArgs.K8sPodName != "" {
+		var pod *v1.Pod
+		pod, err = meta.getPod(ctx, string(k8sArgs.K8sPodNamespace), string(k8sArgs.K8sPodName))
+		if err == nil {
+			var options *cmd.RootOptions
+			if options, err = buildOptions(ctx, meta, pod, conf, args.Netns, logEntry); err == nil {
+				return options
+			}
+		}
+	}
+	if err != nil {
+		logEntry.Warnf("linkerd-cni: cleaning up with the plugin configuration only, the pod annotations are unknown: %s", err)
+	}
+
+	options := configOptions(conf, args.Netns)
+	return &options
+}
+
+// configOptions returns the options of the plugin configuration.
+func configOptions(conf *PluginConf, netns string) cmd.RootOptions {
+	return cmd.RootOptions{
+		IncomingProxyPort:               conf.ProxyInit.IncomingProxyPort,
+		OutgoingProxyPort:               conf.ProxyInit.OutgoingProxyPort,
+		ProxyUserID:                     conf.ProxyInit.ProxyUID,
+		ProxyGroupID:                    conf.ProxyInit.ProxyGID,
+		ProxyCgroupPath:                 conf.ProxyInit.ProxyCgroupPath,
+		ProxyMark:                       conf.ProxyInit.ProxyMark,
+		PortsToRedirect:                 conf.ProxyInit.PortsToRedirect,
+		InboundPortsToIgnore:            conf.ProxyInit.InboundPortsToIgnore,
+		InboundPortsToIgnoreFromSubnets: conf.ProxyInit.InboundPortsToIgnoreFromSubnets,
+		OutboundPortsToIgnore:           conf.ProxyInit.OutboundPortsToIgnore,
+		SubnetsToIgnore:                 conf.ProxyInit.SubnetsToIgnore,
+		OutboundSubnetsToIgnore:         conf.ProxyInit.OutboundSubnetsToIgnore,
+		UseSets:                         conf.ProxyInit.UseSets,
+		SimulateOnly:                    conf.ProxyInit.Simulate,
+		NetNs:                           netns,
+		UseWaitFlag:                     conf.ProxyInit.UseWaitFlag,
+		IPTablesMode:                    conf.ProxyInit.IPTablesMode,
+		IPv6:                            conf.ProxyInit.IPv6,
+		OutboundDNSProxyPort:            conf.ProxyInit.OutboundDNSProxyPort,
+		LenientPortValidation:           conf.ProxyInit.LenientPortValidation,
+	}
+}
+
+// buildOptions returns the options to configure the pod's firewall with,
+// starting from the plugin configuration and applying the overrides from the
+// pod and namespace annotations.
+func buildOptions(ctx context.Context, meta podMetadata, pod *v1.Pod, conf *PluginConf, netns string, logEntry *logrus.Entry) (*cmd.RootOptions, error) {
+	options := configOptions(conf, netns)
+
+	policies, err := mergePolicies(conf.ProxyInit.MergePolicy)
+	if err != nil {
+		logEntry.Errorf("linkerd-cni: invalid configuration: %s", err)
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "linkerd-cni: invalid merge policy", err.Error())
+	}
+
+	// the rules are installed before the containers of the pod get their
+	// cgroup, so the proxy can only be exempted by its user or mark
+	if conf.ProxyInit.ProxyCgroupPath != "" {
+		logEntry.Errorf("linkerd-cni: invalid configuration: proxy-cgroup-path is not supported")
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "linkerd-cni: proxy-cgroup-path is not supported", "the proxy container cgroup doesn't exist yet when the rules are installed, use proxy-mark instead")
+	}
+
+	resolver, err := newAnnotationResolver(ctx, meta, pod)
+	if err != nil {
+		logEntry.Errorf("linkerd-cni: could not retrieve overridden annotations: %s", err)
+		return nil, err
+	}
+
+	overrides, err := resolver.overrides()
+	if err != nil {
+		logEntry.Errorf("linkerd-cni: could not parse overridden annotations: %s", err)
+		return nil, types.NewError(errCodeInvalidOptions, "linkerd-cni: invalid annotations", err.Error())
+	}
+
+	if overrides.IncomingProxyPort != nil {
+		logEntry.Debugf("linkerd-cni: overriding IncomingProxyPort to %d", *overrides.IncomingProxyPort)
+		options.IncomingProxyPort = *overrides.IncomingProxyPort
+	}
+
+	if overrides.OutgoingProxyPort != nil {
+		logEntry.Debugf("linkerd-cni: overriding OutgoingProxyPort to %d", *overrides.OutgoingProxyPort)
+		options.OutgoingProxyPort = *overrides.OutgoingProxyPort
+	}
+
+	if overrides.IPTablesMode != "" {
+		logEntry.Debugf("linkerd-cni: overriding IPTablesMode to %s", overrides.IPTablesMode)
+		options.IPTablesMode = overrides.IPTablesMode
+	}
+
+	if overrides.IPv6 != nil {
+		logEntry.Debugf("linkerd-cni: overriding IPv6 to %t", *overrides.IPv6)
+		options.IPv6 = *overrides.IPv6
+	}
+
+	// Check if there are any overridden ports to be skipped, merged below
+	// once validated
+	if overrides.OutboundPortsToIgnore != nil {
+		logEntry.Debugf("linkerd-cni: overriding OutboundPortsToIgnore to %v (%s)", overrides.OutboundPortsToIgnore, policies["outbound-ports-to-ignore"])
+	}
+
+	if overrides.InboundPortsToIgnore != nil {
+		logEntry.Debugf("linkerd-cni: overriding InboundPortsToIgnore to %v (%s)", overrides.InboundPortsToIgnore, policies["inbound-ports-to-ignore"])
+	}
+
+	if overrides.InboundPortsToIgnoreFromSubnets != nil {
+		logEntry.Debugf("linkerd-cni: overriding InboundPortsToIgnoreFromSubnets to %v (%s)", overrides.InboundPortsToIgnoreFromSubnets, policies["inbound-ports-to-ignore-from-subnets"])
+	}
+
+	// Check if there are any subnets to skip
+	if overrides.SubnetsToIgnore != nil {
+		logEntry.Debugf("linkerd-cni: overriding SubnetsToIgnore to %v (%s)", overrides.SubnetsToIgnore, policies["subnets-to-ignore"])
+		options.SubnetsToIgnore = merge(policies["subnets-to-ignore"], options.SubnetsToIgnore, overrides.SubnetsToIgnore)
+	}
+
+	// Check if there are any outbound destination subnets to skip
+	if overrides.OutboundSubnetsToIgnore != nil {
+		logEntry.Debugf("linkerd-cni: overriding OutboundSubnetsToIgnore to %v (%s)", overrides.OutboundSubnetsToIgnore, policies["outbound-subnets-to-ignore"])
+		options.OutboundSubnetsToIgnore = merge(policies["outbound-subnets-to-ignore"], options.OutboundSubnetsToIgnore, overrides.OutboundSubnetsToIgnore)
+	}
+
+	if overrides.ProxyUID != nil {
+		logEntry.Debugf("linkerd-cni: overriding ProxyUID to %d", *overrides.ProxyUID)
+		options.ProxyUserID = *overrides.ProxyUID
+	}
+
+	if overrides.ProxyGID != nil {
+		logEntry.Debugf("linkerd-cni: overriding ProxyGID to %d", *overrides.ProxyGID)
+		options.ProxyGroupID = *overrides.ProxyGID
+	}
+
+	if overrides.ProxyMark != nil {
+		logEntry.Debugf("linkerd-cni: overriding ProxyMark to %#x", *overrides.ProxyMark)
+		options.ProxyMark = *overrides.ProxyMark
+	}
+
+	if overrides.OutboundDNSProxyPort != nil {
+		logEntry.Debugf("linkerd-cni: overriding OutboundDNSProxyPort to %d", *overrides.OutboundDNSProxyPort)
+		options.OutboundDNSProxyPort = *overrides.OutboundDNSProxyPort
+	}
+
+	// The invalid entries of the port lists are all reported at once, naming
+	// the annotation or configuration field they come from.
+	portErrs := []error{}
+
+	if overrides.PortsToRedirect != nil {
+		logEntry.Debugf("linkerd-cni: overriding PortsToRedirect to %v (%s)", overrides.PortsToRedirect, policies["ports-to-redirect"])
+
+		portsToRedirect, err := resolvePortsToRedirect(pod, annotationPortsToRedirect, overrides.PortsToRedirect, options.LenientPortValidation)
+		portErrs = append(portErrs, err)
+		options.PortsToRedirect = merge(policies["ports-to-redirect"], options.PortsToRedirect, portsToRedirect)
+	}
+
+	// Resolve the named ports of the inbound ports to skip against the
+	// pod's container ports.
+	resolveInbound := func(source string, ports []string) ([]string, error) {
+		return resolveNamedPorts(pod, source, ports, options.LenientPortValidation)
+	}
+	validateOutbound := func(source string, ports []string) ([]string, error) {
+		return ports, validatePorts(source, ports, options.LenientPortValidation)
+	}
+
+	options.InboundPortsToIgnore, err = mergeValidated(policies, "inbound-ports-to-ignore", options.InboundPortsToIgnore, annotationSkipInboundPorts, overrides.InboundPortsToIgnore, resolveInbound)
+	portErrs = append(portErrs, err)
+
+	options.InboundPortsToIgnoreFromSubnets, err = mergeValidated(policies, "inbound-ports-to-ignore-from-subnets", options.InboundPortsToIgnoreFromSubnets, annotationSkipInboundPortsFromSubnets, overrides.InboundPortsToIgnoreFromSubnets, resolveInbound)
+	portErrs = append(portErrs, err)
+
+	options.OutboundPortsToIgnore, err = mergeValidated(policies, "outbound-ports-to-ignore", options.OutboundPortsToIgnore, annotationSkipOutboundPorts, overrides.OutboundPortsToIgnore, validateOutbound)
+	portErrs = append(portErrs, err)
+
+	if err := errors.Join(portErrs...); err != nil {
+		logEntry.Errorf("linkerd-cni: invalid ports: %s", err)
+		return nil, types.NewError(errCodeInvalidOptions, "linkerd-cni: invalid ports", err.Error())
+	}
+
+	if pod.GetLabels()["linkerd.io/control-plane-component"] != "" {
+		// Skip k8s api server ports on the outbound side if pod is a
+		// control plane component
+		skippedPorts, err := getAPIServerPorts(ctx, meta)
+		if err != nil {
+			// If we cannot retrieve the 'kubernetes' service's ports (for
+			// whatever reason), skip default ports: 443, 6443
+			logEntry.Errorf("linkerd-cni: could not retrieve ports from 'kubernetes' service: %v", err)
+			skippedPorts = []string{"443", "6443"}
+		}
+
+		logEntry.Debugf("linkerd-cni: adding %v to OutboundPortsToIgnore as its a control plane component", skippedPorts)
+		options.OutboundPortsToIgnore = append(options.OutboundPortsToIgnore, skippedPorts...)
+	}
+
+	// This ensures BC against linkerd2-cni older versions not yet passing this flag
+	if options.IPTablesMode == "" {
+		options.IPTablesMode = cmd.IPTablesModeLegacy
+	}
+
+	if err := cmd.ValidateSubnetFamilies(&options); err != nil {
+		logEntry.Errorf("linkerd-cni: invalid subnets to ignore: %s", err)
+		return nil, types.NewError(errCodeInvalidOptions, "linkerd-cni: invalid subnets to ignore", err.Error())
+	}
+
+	return &options, nil
+}
+
+func containsLinkerdInit(spec *v1.PodSpec) bool {
+	for _, container := range spec.InitContainers {
+		if container.Name == "linkerd-init" {
+			return true
+		}
+	}
+
+	return false
+}
+
 func containsLinkerdProxy(spec *v1.PodSpec) bool {
 	for _, container := range spec.Containers {
 		if container.Name == "linkerd-proxy" {
@@ -386,8 +693,8 @@ func containsLinkerdProxy(spec *v1.PodSpec) bool {
 	return false
 }
 
-func getAPIServerPorts(ctx context.Context, api *kubernetes.Clientset) ([]string, error) {
-	service, err := api.CoreV1().Services("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+func getAPIServerPorts(ctx context.Context, meta podMetadata) ([]string, error) {
+	service, err := meta.getService(ctx, "default", "kubernetes")
 	if err != nil {
 		return []string{}, err
 	}
@@ -403,10 +710,40 @@ func getAPIServerPorts(ctx context.Context, api *kubernetes.Clientset) ([]string
 	return ports, nil
 }
 
-func buildAndConfigure(logEntry *logrus.Entry, options *cmd.RootOptions) error {
+// forEachIPFamily calls fn with the options of every IP family to be handled:
+// the IPv4 ones first, followed by the IPv6 ones when enabled. In nftables
+// mode a single call handles both families.
+func forEachIPFamily(options *cmd.RootOptions, fn func(*cmd.RootOptions) error) error {
+	// nftables handles both IPv4 and IPv6 from a single inet table
+	if options.IPTablesMode == cmd.IPTablesModeNFTables {
+		return fn(options)
+	}
+
+	// always trigger the IPv4 rules
+	optIPv4 := *options
+	optIPv4.IPv6 = false
+	if err := fn(&optIPv4); err != nil {
+		return err
+	}
+
+	// trigger the IPv6 rules
+	if options.IPv6 {
+		return fn(options)
+	}
+
+	return nil
+}
+
+func (p *plugin) buildAndConfigure(logEntry *logrus.Entry, options *cmd.RootOptions) error {
 	firewallConfiguration, err := cmd.BuildFirewallConfiguration(options)
 	if err != nil {
 		logEntry.Errorf("linkerd-cni: could not create a Firewall Configuration from the options: %v", options)
+		return types.NewError(errCodeInvalidOptions, "linkerd-cni: invalid firewall options", err.Error())
+	}
+	firewallConfiguration.Backend = p.backend
+
+	if err := p.checkIPSet(firewallConfiguration); err != nil {
+		logEntry.Errorf("linkerd-cni: %s", err)
 		return err
 	}
 
@@ -418,21 +755,45 @@ func buildAndConfigure(logEntry *logrus.Entry, options *cmd.RootOptions) error {
 	return nil
 }
 
-func getAnnotationOverride(ctx context.Context, api *kubernetes.Clientset, pod *v1.Pod, key string) (string, error) {
-	// Check if the annotation is present on the pod
-	if override := pod.GetObjectMeta().GetAnnotations()[key]; override != "" {
-		return override, nil
+// checkIPSet makes sure the ipset binary, which the iptables modes run on the
+// host through nsenter to hold the ignored ports and subnets, is installed
+// before any rule is.
+func (p *plugin) checkIPSet(fc *iptables.FirewallConfiguration) error {
+	if !fc.UseSets || fc.NFTables || fc.SimulateOnly {
+		return nil
 	}
 
-	// Check if the annotation is present on the namespace
-	ns, err := api.CoreV1().Namespaces().Get(ctx, pod.GetObjectMeta().GetNamespace(), metav1.GetOptions{})
+	if _, err := p.lookPath("ipset"); err != nil {
+		return types.NewError(errCodeInvalidOptions, "linkerd-cni: use-sets requires the ipset binary on the host, or the nftables mode", err.Error())
+	}
+
+	return nil
+}
+
+func (p *plugin) buildAndVerify(logEntry *logrus.Entry, options *cmd.RootOptions) ([]iptables.Drift, error) {
+	firewallConfiguration, err := cmd.BuildFirewallConfiguration(options)
 	if err != nil {
-		return "", err
+		logEntry.Errorf("linkerd-cni: could not create a Firewall Configuration from the options: %v", options)
+		return nil, types.NewError(errCodeInvalidOptions, "linkerd-cni: invalid firewall options", err.Error())
 	}
+	firewallConfiguration.Backend = p.backend
 
-	if override := ns.GetObjectMeta().GetAnnotations()[key]; override != "" {
-		return override, nil
+	drifts, err := iptables.VerifyFirewall(*firewallConfiguration)
+	if err != nil {
+		logEntry.Errorf("linkerd-cni: could not verify firewall: %s", err)
+		return nil, err
+	}
+
+	return drifts, nil
+}
+
+func (p *plugin) buildAndCleanup(logEntry *logrus.Entry, options *cmd.RootOptions) error {
+	firewallConfiguration, err := cmd.BuildFirewallConfiguration(options)
+	if err != nil {
+		logEntry.Errorf("linkerd-cni: could not create a Firewall Configuration from the options: %v", options)
+		return err
 	}
+	firewallConfiguration.Backend = p.backend
 
-	return "", nil
+	return iptables.CleanupFirewallConfig(*firewallConfiguration)
 }
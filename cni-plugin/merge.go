@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The policies merging the lists of the plugin configuration with the ones
+// overridden by annotations.
+const (
+	// mergePolicyAppend appends the annotation entries to the configured
+	// ones.
+	mergePolicyAppend = "append"
+	// mergePolicyReplace replaces the configured entries with the annotation
+	// ones.
+	mergePolicyReplace = "replace"
+)
+
+// defaultMergePolicies are the policies of the fields overridable by
+// annotations, keyed by field name, applying when the "merge-policy" of the
+// plugin configuration doesn't set them. The inbound ports to ignore are
+// appended, since the proxy ports listed in the configuration must stay
+// skipped, while the other lists are replaced.
+var defaultMergePolicies = map[string]string{
+	"inbound-ports-to-ignore":              mergePolicyAppend,
+	"inbound-ports-to-ignore-from-subnets": mergePolicyReplace,
+	"outbound-ports-to-ignore":             mergePolicyReplace,
+	"subnets-to-ignore":                    mergePolicyReplace,
+	"outbound-subnets-to-ignore":           mergePolicyReplace,
+	"ports-to-redirect":                    mergePolicyReplace,
+}
+
+// mergePolicies returns the policy of every field overridable by
+// annotations, those configured taking precedence over the defaults. Every
+// unknown field or policy is reported.
+func mergePolicies(configured map[string]string) (map[string]string, error) {
+	policies := make(map[string]string, len(defaultMergePolicies))
+	for field, policy := range defaultMergePolicies {
+		policies[field] = policy
+	}
+
+	fields := make([]string, 0, len(configured))
+	for field := range configured {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	errs := []error{}
+	for _, field := range fields {
+		policy := configured[field]
+		if _, ok := defaultMergePolicies[field]; !ok {
+			errs = append(errs, fmt.Errorf("merge-policy: unknown field %q", field))
+			continue
+		}
+		if policy != mergePolicyAppend && policy != mergePolicyReplace {
+			errs = append(errs, fmt.Errorf("merge-policy: invalid policy %q for %s: valid values are only %q and %q", policy, field, mergePolicyAppend, mergePolicyReplace))
+			continue
+		}
+		policies[field] = policy
+	}
+
+	return policies, errors.Join(errs...)
+}
+
+// merge returns the configured entries merged with the overridden ones
+// according to the policy. The configured slice is never modified.
+func merge[T any](policy string, configured []T, overridden []T) []T {
+	if policy == mergePolicyReplace {
+		return overridden
+	}
+
+	merged := make([]T, 0, len(configured)+len(overridden))
+	merged = append(merged, configured...)
+	return append(merged, overridden...)
+}
+
+// mergeValidated validates the configured and the overridden entries of the
+// field separately, so that the errors name the configuration field or the
+// annotation they come from, and merges them according to the policy of the
+// field. The configured entries dropped by the replace policy aren't
+// validated.
+func mergeValidated[T any](policies map[string]string, field string, configured []T, annotation string, overridden []T, validate func(source string, entries []T) ([]T, error)) ([]T, error) {
+	if overridden == nil {
+		return validate(field, configured)
+	}
+
+	validated, err := validate(annotation, overridden)
+	if policies[field] == mergePolicyReplace {
+		return validated, err
+	}
+
+	kept, configErr := validate(field, configured)
+	return merge(policies[field], kept, validated), errors.Join(configErr, err)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMergePolicies(t *testing.T) {
+	policies, err := mergePolicies(map[string]string{"outbound-ports-to-ignore": mergePolicyAppend})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if policies["outbound-ports-to-ignore"] != mergePolicyAppend {
+		t.Errorf("expected the configured policy to apply, got %s", policies["outbound-ports-to-ignore"])
+	}
+	if policies["inbound-ports-to-ignore"] != mergePolicyAppend || policies["subnets-to-ignore"] != mergePolicyReplace {
+		t.Errorf("expected the default policies to apply, got %v", policies)
+	}
+
+	_, err = mergePolicies(map[string]string{"proxy-uid": mergePolicyAppend, "subnets-to-ignore": "prepend"})
+	expected := `merge-policy: unknown field "proxy-uid"
+merge-policy: invalid policy "prepend" for subnets-to-ignore: valid values are only "append" and "replace"`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error\n[%s]\nbut got\n[%v]", expected, err)
+	}
+}
+
+func TestBuildOptions_MergePolicy(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(nil))
+	pod := newTestPod(map[string]string{
+		annotationSkipInboundPorts:  "25",
+		annotationSkipOutboundPorts: "3306",
+		annotationSkipSubnets:       "192.168.0.0/16",
+		annotationPortsToRedirect:   "8080",
+	})
+	configured := ProxyInit{
+		IncomingProxyPort:     4143,
+		OutgoingProxyPort:     4140,
+		PortsToRedirect:       []int{80},
+		InboundPortsToIgnore:  []string{"4190", "4191"},
+		OutboundPortsToIgnore: []string{"443"},
+		SubnetsToIgnore:       []string{"10.0.0.0/8"},
+	}
+
+	for _, tt := range []struct {
+		name                  string
+		mergePolicy           map[string]string
+		inboundPortsToIgnore  []string
+		outboundPortsToIgnore []string
+		subnetsToIgnore       []string
+		portsToRedirect       []int
+	}{
+		{
+			name:                  "default",
+			inboundPortsToIgnore:  []string{"4190", "4191", "25"},
+			outboundPortsToIgnore: []string{"3306"},
+			subnetsToIgnore:       []string{"192.168.0.0/16"},
+			portsToRedirect:       []int{8080},
+		},
+		{
+			name: "append",
+			mergePolicy: map[string]string{
+				"outbound-ports-to-ignore": mergePolicyAppend,
+				"subnets-to-ignore":        mergePolicyAppend,
+				"ports-to-redirect":        mergePolicyAppend,
+			},
+			inboundPortsToIgnore:  []string{"4190", "4191", "25"},
+			outboundPortsToIgnore: []string{"443", "3306"},
+			subnetsToIgnore:       []string{"10.0.0.0/8", "192.168.0.0/16"},
+			portsToRedirect:       []int{80, 8080},
+		},
+		{
+			name:                  "replace",
+			mergePolicy:           map[string]string{"inbound-ports-to-ignore": mergePolicyReplace},
+			inboundPortsToIgnore:  []string{"25"},
+			outboundPortsToIgnore: []string{"3306"},
+			subnetsToIgnore:       []string{"192.168.0.0/16"},
+			portsToRedirect:       []int{8080},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyInit := configured
+			proxyInit.MergePolicy = tt.mergePolicy
+			conf := &PluginConf{ProxyInit: proxyInit}
+
+			options, err := buildOptions(context.Background(), &apiMetadata{client: client}, pod, conf, "", logrus.NewEntry(logrus.StandardLogger()))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(options.InboundPortsToIgnore, tt.inboundPortsToIgnore) {
+				t.Errorf("expected InboundPortsToIgnore %v, got %v", tt.inboundPortsToIgnore, options.InboundPortsToIgnore)
+			}
+			if !reflect.DeepEqual(options.OutboundPortsToIgnore, tt.outboundPortsToIgnore) {
+				t.Errorf("expected OutboundPortsToIgnore %v, got %v", tt.outboundPortsToIgnore, options.OutboundPortsToIgnore)
+			}
+			if !reflect.DeepEqual(options.SubnetsToIgnore, tt.subnetsToIgnore) {
+				t.Errorf("expected SubnetsToIgnore %v, got %v", tt.subnetsToIgnore, options.SubnetsToIgnore)
+			}
+			if !reflect.DeepEqual(options.PortsToRedirect, tt.portsToRedirect) {
+				t.Errorf("expected PortsToRedirect %v, got %v", tt.portsToRedirect, options.PortsToRedirect)
+			}
+		})
+	}
+
+	// the configured lists must be left untouched by the appends
+	if !reflect.DeepEqual(configured.InboundPortsToIgnore, []string{"4190", "4191"}) || !reflect.DeepEqual(configured.PortsToRedirect, []int{80}) {
+		t.Fatalf("expected the configuration to be left untouched, got %+v", configured)
+	}
+}
+
+func TestBuildOptions_MergePolicyErrors(t *testing.T) {
+	client := fake.NewClientset(newTestNamespace(nil))
+	pod := newTestPod(map[string]string{
+		annotationSkipInboundPorts:  "25,smtp",
+		annotationSkipOutboundPorts: "3306",
+	})
+	conf := &PluginConf{ProxyInit: ProxyInit{
+		IncomingProxyPort:     4143,
+		OutgoingProxyPort:     4140,
+		InboundPortsToIgnore:  []string{"4190", "metrics"},
+		OutboundPortsToIgnore: []string{"70000"},
+	}}
+
+	// the configured entries are reported under the configuration field,
+	// while the ones replaced by the annotation aren't reported at all
+	_, err := buildOptions(context.Background(), &apiMetadata{client: client}, pod, conf, "", logrus.NewEntry(logrus.StandardLogger()))
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != errCodeInvalidOptions {
+		t.Fatalf("expected a CNI error with code %d, got %v", errCodeInvalidOptions, err)
+	}
+	expected := `inbound-ports-to-ignore: invalid entry "metrics": neither a port, a port range nor a named port of pod emojivoto/pod
+config.linkerd.io/skip-inbound-ports: invalid entry "smtp": neither a port, a port range nor a named port of pod emojivoto/pod`
+	if cniErr.Details != expected {
+		t.Fatalf("expected error\n[%s]\nbut got\n[%s]", expected, cniErr.Details)
+	}
+}
+
+func TestBuildOptions_InvalidMergePolicy(t *testing.T) {
+	conf := &PluginConf{ProxyInit: ProxyInit{MergePolicy: map[string]string{"outbound-ports-to-ignore": "merge"}}}
+	_, err := buildOptions(context.Background(), &apiMetadata{client: fake.NewClientset(newTestNamespace(nil))}, newTestPod(nil), conf, "", logrus.NewEntry(logrus.StandardLogger()))
+
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != types.ErrInvalidNetworkConfig || !strings.Contains(cniErr.Details, "outbound-ports-to-ignore") {
+		t.Fatalf("expected an invalid network config error, got %v", err)
+	}
+}
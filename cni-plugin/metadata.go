@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+
+	"github.com/linkerd/linkerd2-proxy-init/internal/metadata"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podMetadata fetches the objects the options of a pod are built from.
+type podMetadata interface {
+	getPod(ctx context.Context, namespace, name string) (*v1.Pod, error)
+	getNamespace(ctx context.Context, name string) (*v1.Namespace, error)
+	getService(ctx context.Context, namespace, name string) (*v1.Service, error)
+}
+
+// newPodMetadata returns the metadata source of the plugin: the node-local
+// cache when configured, falling back to the API server.
+func newPodMetadata(conf *PluginConf) podMetadata {
+	api := &apiMetadata{conf: conf}
+	if conf.MetadataCacheSocket == "" {
+		return api
+	}
+
+	return &cachedMetadata{cache: metadata.NewClient(conf.MetadataCacheSocket), fallback: api}
+}
+
+// apiMetadata fetches the objects from the API server. The client is only
+// created on first use, so that it isn't when the cache answers.
+type apiMetadata struct {
+	conf   *PluginConf
+	client kubernetes.Interface
+}
+
+func (m *apiMetadata) clientset() (kubernetes.Interface, error) {
+	if m.client == nil {
+		client, err := newKubernetesClient(m.conf)
+		if err != nil {
+			return nil, err
+		}
+		m.client = client
+	}
+
+	return m.client, nil
+}
+
+func (m *apiMetadata) getPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	client, err := m.clientset()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (m *apiMetadata) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	client, err := m.clientset()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (m *apiMetadata) getService(ctx context.Context, namespace, name string) (*v1.Service, error) {
+	client, err := m.clientset()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// cachedMetadata fetches the objects from the metadata cache served by
+// linkerd-cni, falling back to the API server when the cache is unavailable
+// or didn't catch up with the object yet.
+type cachedMetadata struct {
+	cache    *metadata.Client
+	fallback podMetadata
+}
+
+func (m *cachedMetadata) getPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	pod, err := m.cache.Pod(ctx, namespace, name)
+	if err != nil {
+		logrus.Debugf("linkerd-cni: falling back to the API server: %s", err)
+		return m.fallback.getPod(ctx, namespace, name)
+	}
+
+	return pod, nil
+}
+
+func (m *cachedMetadata) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns, err := m.cache.Namespace(ctx, name)
+	if err != nil {
+		logrus.Debugf("linkerd-cni: falling back to the API server: %s", err)
+		return m.fallback.getNamespace(ctx, name)
+	}
+
+	return ns, nil
+}
+
+func (m *cachedMetadata) getService(ctx context.Context, namespace, name string) (*v1.Service, error) {
+	service, err := m.cache.Service(ctx, namespace, name)
+	if err != nil {
+		logrus.Debugf("linkerd-cni: falling back to the API server: %s", err)
+		return m.fallback.getService(ctx, namespace, name)
+	}
+
+	return service, nil
+}
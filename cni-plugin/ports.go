@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/util"
+	v1 "k8s.io/api/core/v1"
+)
+
+// resolveNamedPorts replaces the container port names found among the ports
+// and port ranges with their number, as declared by the containers of the
+// pod. Names can be excluded with a "!" prefix like ports, and entries of the
+// <port or range>@<subnet> form have their port part resolved. Every entry
+// that can't be resolved is reported, naming source, the annotation or
+// configuration field the ports come from. When lenient is set they are kept
+// as is instead, for BuildFirewallConfiguration to skip them.
+func resolveNamedPorts(pod *v1.Pod, source string, ports []string, lenient bool) ([]string, error) {
+	resolved := make([]string, 0, len(ports))
+	errs := []error{}
+	for _, port := range ports {
+		port = strings.TrimSpace(port)
+		portRange, subnet, hasSubnet := strings.Cut(port, "@")
+		if _, err := util.ParsePortSet(portRange); err != nil {
+			name, isExclusion := strings.CutPrefix(portRange, "!")
+			number, found := findNamedPort(pod, name)
+			if !found {
+				if !lenient {
+					errs = append(errs, fmt.Errorf("%s: invalid entry %q: neither a port, a port range nor a named port of pod %s/%s", source, port, pod.GetNamespace(), pod.GetName()))
+				}
+				resolved = append(resolved, port)
+				continue
+			}
+			portRange = strconv.Itoa(number)
+			if isExclusion {
+				portRange = "!" + portRange
+			}
+		}
+
+		if hasSubnet {
+			portRange = portRange + "@" + subnet
+		}
+		resolved = append(resolved, portRange)
+	}
+
+	return resolved, errors.Join(errs...)
+}
+
+// validatePorts reports every invalid entry of the ports and port ranges,
+// naming source like resolveNamedPorts. Nothing is reported when lenient is
+// set.
+func validatePorts(source string, ports []string, lenient bool) error {
+	if lenient {
+		return nil
+	}
+
+	errs := []error{}
+	for _, port := range ports {
+		if _, err := util.ParsePortSet(port); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid entry %q: %w", source, port, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// resolvePortsToRedirect parses the ports to redirect, which can be port
+// numbers or container port names. Invalid entries are all reported, or
+// skipped when lenient is set.
+func resolvePortsToRedirect(pod *v1.Pod, source string, ports []string, lenient bool) ([]int, error) {
+	parsed := make([]int, 0, len(ports))
+	errs := []error{}
+	for _, port := range ports {
+		port = strings.TrimSpace(port)
+		number, err := util.ParsePort(port)
+		if err != nil {
+			var found bool
+			if number, found = findNamedPort(pod, port); !found {
+				if !lenient {
+					errs = append(errs, fmt.Errorf("%s: invalid entry %q: neither a port nor a named port of pod %s/%s", source, port, pod.GetNamespace(), pod.GetName()))
+				}
+				continue
+			}
+		}
+		parsed = append(parsed, number)
+	}
+
+	return parsed, errors.Join(errs...)
+}
+
+// findNamedPort returns the number of the container port with the provided
+// name, looking into the init containers as well since they can be native
+// sidecars.
+func findNamedPort(pod *v1.Pod, name string) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+
+	containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if port.Name == name {
+				return int(port.ContainerPort), true
+			}
+		}
+	}
+
+	return 0, false
+}
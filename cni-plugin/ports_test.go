@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func newNamedPortsTestPod() *v1.Pod {
+	pod := newTestPod(nil)
+	pod.Spec.InitContainers = []v1.Container{{
+		Name:  "sidecar",
+		Ports: []v1.ContainerPort{{Name: "metrics", ContainerPort: 9100}},
+	}}
+	pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+		Name:  "admin",
+		Ports: []v1.ContainerPort{{Name: "admin-http", ContainerPort: 9991}, {Name: "metrics", ContainerPort: 9101}},
+	})
+	return pod
+}
+
+func TestResolveNamedPorts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ports    []string
+		lenient  bool
+		expected []string
+		// errs are the entries expected to be reported
+		errs []string
+	}{
+		{
+			name:     "ports and ranges",
+			ports:    []string{"25", "4190-4191", "!4191", " 8080 "},
+			expected: []string{"25", "4190-4191", "!4191", "8080"},
+		},
+		{
+			name:     "names",
+			ports:    []string{"admin-http", "4190"},
+			expected: []string{"9990", "4190"},
+		},
+		{
+			name:     "excluded names",
+			ports:    []string{"9000-9999", "!admin-http"},
+			expected: []string{"9000-9999", "!9990"},
+		},
+		{
+			name:     "names with subnets",
+			ports:    []string{"admin-http@10.0.0.0/8", "!metrics@192.168.0.0/16", "25@fd00::/8"},
+			expected: []string{"9990@10.0.0.0/8", "!9100@192.168.0.0/16", "25@fd00::/8"},
+		},
+		{
+			// the names are looked up in the init containers first, then in
+			// the order of the containers
+			name:     "duplicate names",
+			ports:    []string{"metrics", "admin-http"},
+			expected: []string{"9100", "9990"},
+		},
+		{
+			name:     "unknown names",
+			ports:    []string{"admin-http", "grpc", "!grpc@10.0.0.0/8", "!"},
+			expected: []string{"9990", "grpc", "!grpc@10.0.0.0/8", "!"},
+			errs:     []string{`"grpc"`, `"!grpc@10.0.0.0/8"`, `"!"`},
+		},
+		{
+			name:     "unknown names, lenient",
+			ports:    []string{"admin-http", "grpc", "!grpc@10.0.0.0/8"},
+			lenient:  true,
+			expected: []string{"9990", "grpc", "!grpc@10.0.0.0/8"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := resolveNamedPorts(newNamedPortsTestPod(), annotationSkipInboundPorts, tc.ports, tc.lenient)
+			if !reflect.DeepEqual(resolved, tc.expected) {
+				t.Errorf("expected %v but got %v", tc.expected, resolved)
+			}
+
+			if len(tc.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tc.errs) {
+				t.Fatalf("expected %d errors but got %s", len(tc.errs), err)
+			}
+			for i, entry := range tc.errs {
+				expected := annotationSkipInboundPorts + ": invalid entry " + entry + ": neither a port, a port range nor a named port of pod emojivoto/pod"
+				if lines[i] != expected {
+					t.Errorf("expected error\n[%s]\nbut got\n[%s]", expected, lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolvePortsToRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ports    []string
+		lenient  bool
+		expected []int
+		errs     []string
+	}{
+		{
+			name:     "ports and names",
+			ports:    []string{"8080", " admin-http ", "metrics"},
+			expected: []int{8080, 9990, 9100},
+		},
+		{
+			name:     "unknown names and invalid ports",
+			ports:    []string{"8080", "grpc", "70000", "8000-8080"},
+			expected: []int{8080},
+			errs:     []string{`"grpc"`, `"70000"`, `"8000-8080"`},
+		},
+		{
+			name:     "unknown names and invalid ports, lenient",
+			ports:    []string{"8080", "grpc", "70000"},
+			lenient:  true,
+			expected: []int{8080},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ports, err := resolvePortsToRedirect(newNamedPortsTestPod(), annotationPortsToRedirect, tc.ports, tc.lenient)
+			if !reflect.DeepEqual(ports, tc.expected) {
+				t.Errorf("expected %v but got %v", tc.expected, ports)
+			}
+
+			if len(tc.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tc.errs) {
+				t.Fatalf("expected %d errors but got %s", len(tc.errs), err)
+			}
+			for i, entry := range tc.errs {
+				expected := annotationPortsToRedirect + ": invalid entry " + entry + ": neither a port nor a named port of pod emojivoto/pod"
+				if lines[i] != expected {
+					t.Errorf("expected error\n[%s]\nbut got\n[%s]", expected, lines[i])
+				}
+			}
+		})
+	}
+}
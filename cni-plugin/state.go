@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/linkerd/linkerd2-proxy-init/proxy-init/cmd"
+)
+
+// PodState is what cmdAdd records for a container when the plugin is
+// configured with a state_dir, so that cmdDel can undo it.
+type PodState struct {
+	Namespace string          `json:"namespace"`
+	Pod       string          `json:"pod"`
+	Netns     string          `json:"netns"`
+	Options   cmd.RootOptions `json:"options"`
+}
+
+func statePath(stateDir string, containerID string) string {
+	return filepath.Join(stateDir, containerID+".json")
+}
+
+// writeState records the state of the container, replacing any previous
+// record atomically.
+func writeState(stateDir string, containerID string, state *PodState) error {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return fmt.Errorf("linkerd-cni: could not create state directory: %w", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("linkerd-cni: could not serialize state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(stateDir, containerID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("linkerd-cni: could not write state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("linkerd-cni: could not write state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("linkerd-cni: could not write state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), statePath(stateDir, containerID)); err != nil {
+		return fmt.Errorf("linkerd-cni: could not write state: %w", err)
+	}
+
+	return nil
+}
+
+// readState returns the state recorded for the container, or nil if there is
+// none.
+func readState(stateDir string, containerID string) (*PodState, error) {
+	data, err := os.ReadFile(statePath(stateDir, containerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("linkerd-cni: could not read state: %w", err)
+	}
+
+	state := &PodState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("linkerd-cni: could not parse state: %w", err)
+	}
+
+	return state, nil
+}
+
+// removeState removes the state recorded for the container, if any.
+func removeState(stateDir string, containerID string) error {
+	if err := os.Remove(statePath(stateDir, containerID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("linkerd-cni: could not remove state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+	"github.com/linkerd/linkerd2-proxy-init/proxy-init/cmd"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestPlugin returns a plugin fetching the objects from a fake API server
+// and configuring the firewall in memory, on a host with all the binaries.
+func newTestPlugin(objects ...runtime.Object) (*plugin, *iptables.FakeBackend) {
+	backend := iptables.NewFakeBackend()
+	client := fake.NewClientset(objects...)
+	return &plugin{
+		newMetadata: func(*PluginConf) podMetadata { return &apiMetadata{client: client} },
+		backend:     backend,
+		lookPath:    func(file string) (string, error) { return "/usr/sbin/" + file, nil },
+	}, backend
+}
+
+// newTestArgs returns the arguments of a CNI request for the test pod,
+// within an existing network namespace.
+func newTestArgs(t *testing.T, conf *PluginConf) *skel.CmdArgs {
+	t.Helper()
+
+	// the marshaller of the embedded NetConf would hide the other fields
+	stdin, err := json.Marshal(map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       "linkerd-cni",
+		"type":       "linkerd-cni",
+		"state_dir":  conf.StateDir,
+		"linkerd":    conf.ProxyInit,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	netns := filepath.Join(t.TempDir(), "netns")
+	if err := os.WriteFile(netns, nil, 0o600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return &skel.CmdArgs{
+		ContainerID: "container",
+		Netns:       netns,
+		IfName:      "eth0",
+		Args:        "K8S_POD_NAMESPACE=emojivoto;K8S_POD_NAME=pod",
+		StdinData:   stdin,
+	}
+}
+
+func newMeshedTestPod(annotations map[string]string) *v1.Pod {
+	pod := newTestPod(annotations)
+	pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: "linkerd-proxy"})
+	return pod
+}
+
+func TestState(t *testing.T) {
+	stateDir := t.TempDir()
+
+	state, err := readState(stateDir, "container")
+	if err != nil || state != nil {
+		t.Fatalf("expected no state, got %+v (%v)", state, err)
+	}
+
+	expected := &PodState{
+		Namespace: "emojivoto",
+		Pod:       "pod",
+		Netns:     "/var/run/netns/pod",
+		Options: cmd.RootOptions{
+			IncomingProxyPort:    4143,
+			OutgoingProxyPort:    4140,
+			InboundPortsToIgnore: []string{"4190", "4191"},
+			IPTablesMode:         cmd.IPTablesModeNFTables,
+			IPv6:                 true,
+			UseSets:              true,
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := writeState(stateDir, "container", expected); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	state, err = readState(stateDir, "container")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Fatalf("expected state %+v but got %+v", expected, state)
+	}
+
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected a single state file, got %d", len(entries))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := removeState(stateDir, "container"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if state, err := readState(stateDir, "container"); err != nil || state != nil {
+		t.Fatalf("expected the state to be removed, got %+v (%v)", state, err)
+	}
+}
+
+func TestCmdDel(t *testing.T) {
+	// the pod overrides the iptables mode and enables IPv6, which the
+	// cleanup only knows about from the recorded state or the pod itself
+	annotations := map[string]string{
+		annotationIPTablesMode:     cmd.IPTablesModeLegacy,
+		annotationEnableIPv6:       "true",
+		annotationSkipInboundPorts: "admin-http",
+	}
+
+	for _, tc := range []struct {
+		name string
+		// stateDir configures a state_dir for the plugin
+		stateDir bool
+		// mutate runs between ADD and DEL
+		mutate func(t *testing.T, p *plugin, args *skel.CmdArgs, backend *iptables.FakeBackend)
+		// cleaned is whether the rules are expected to be gone after DEL
+		cleaned bool
+	}{
+		{
+			name:     "state",
+			stateDir: true,
+			cleaned:  true,
+		},
+		{
+			name:     "state, pod gone",
+			stateDir: true,
+			mutate: func(_ *testing.T, p *plugin, _ *skel.CmdArgs, _ *iptables.FakeBackend) {
+				client := fake.NewClientset()
+				p.newMetadata = func(*PluginConf) podMetadata { return &apiMetadata{client: client} }
+			},
+			cleaned: true,
+		},
+		{
+			name:    "no state_dir",
+			cleaned: true,
+		},
+		{
+			name:     "no state file",
+			stateDir: true,
+			mutate: func(t *testing.T, _ *plugin, args *skel.CmdArgs, _ *iptables.FakeBackend) {
+				conf, _ := parseConfig(args.StdinData)
+				if err := removeState(conf.StateDir, args.ContainerID); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			},
+			cleaned: false,
+		},
+		{
+			name:     "corrupt state file",
+			stateDir: true,
+			mutate: func(t *testing.T, _ *plugin, args *skel.CmdArgs, _ *iptables.FakeBackend) {
+				conf, _ := parseConfig(args.StdinData)
+				if err := os.WriteFile(statePath(conf.StateDir, args.ContainerID), []byte(`{"namespace":"emoji`), 0o600); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			},
+			cleaned: true,
+		},
+		{
+			name:     "netns gone",
+			stateDir: true,
+			mutate: func(t *testing.T, _ *plugin, args *skel.CmdArgs, _ *iptables.FakeBackend) {
+				if err := os.Remove(args.Netns); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			},
+			cleaned: false,
+		},
+		{
+			name:     "no netns",
+			stateDir: true,
+			mutate: func(_ *testing.T, _ *plugin, args *skel.CmdArgs, _ *iptables.FakeBackend) {
+				args.Netns = ""
+			},
+			cleaned: false,
+		},
+		{
+			name:     "cleanup failure",
+			stateDir: true,
+			mutate: func(_ *testing.T, _ *plugin, _ *skel.CmdArgs, backend *iptables.FakeBackend) {
+				backend.CleanupErr = errors.New("chain PROXY_INIT_REDIRECT does not exist")
+			},
+			cleaned: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, backend := newTestPlugin(newTestNamespace(nil), newMeshedTestPod(annotations))
+
+			conf := &PluginConf{ProxyInit: ProxyInit{
+				IncomingProxyPort: 4143,
+				OutgoingProxyPort: 4140,
+				UseSets:           true,
+				IPTablesMode:      cmd.IPTablesModeNFTables,
+			}}
+			if tc.stateDir {
+				conf.StateDir = t.TempDir()
+			}
+			args := newTestArgs(t, conf)
+
+			if err := p.cmdAdd(args); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(backend.Sets) != 2 {
+				t.Fatalf("expected the IPv4 and IPv6 sets to be installed, got %v", backend.Sets)
+			}
+
+			if tc.mutate != nil {
+				tc.mutate(t, p, args, backend)
+			}
+
+			// DEL may be called several times for the same container
+			for i := 0; i < 2; i++ {
+				if err := p.cmdDel(args); err != nil {
+					t.Fatalf("unexpected error on DEL #%d: %s", i+1, err)
+				}
+			}
+
+			if cleaned := len(backend.Tables["nat"]) == 0 && len(backend.Sets) == 0; cleaned != tc.cleaned {
+				t.Errorf("expected the rules to be cleaned up: %t, got tables %v and sets %v", tc.cleaned, backend.Tables, backend.Sets)
+			}
+
+			if tc.stateDir {
+				if state, err := readState(conf.StateDir, args.ContainerID); err != nil || state != nil {
+					t.Errorf("expected the state to be removed, got %+v (%v)", state, err)
+				}
+			}
+		})
+	}
+}
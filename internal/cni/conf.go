@@ -65,6 +65,7 @@ type source interface {
 func (i *installer) configureCNI(sources []source) ([]byte, error) {
 	variables := [][2][]byte{
 		{[]byte("__KUBECONFIG_FILEPATH__"), []byte(pluginKubeConfigFilename())},
+		{[]byte("__METADATA_CACHE_SOCKET__"), []byte(metadataCacheSocket.get())},
 	}
 	var data []byte
 	var err error
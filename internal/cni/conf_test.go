@@ -57,6 +57,24 @@ func TestConfigureCNI(t *testing.T) {
 				t.Setenv(kubeConfigFilenameVar.key, "/test-linkerd-cni-kubeconfig")
 			},
 		},
+		{
+			name: "MetadataCacheSocket",
+			sources: []source{
+				&environmentSource{
+					key: "CNI_NETWORK_CONFIG",
+				},
+			},
+			expConfig: map[string]any{
+				"type":                  "linkerd-cni",
+				"metadata_cache_socket": "/var/run/linkerd-cni/metadata.sock",
+			},
+			expErr: "",
+			setup: func(t *testing.T, _ *test) {
+				t.Setenv("CNI_NETWORK_CONFIG", `{"type": "linkerd-cni", "metadata_cache_socket": "__METADATA_CACHE_SOCKET__"}`)
+				t.Setenv(containerMountPrefix.key, "/media")
+				t.Setenv(metadataCacheSocket.key, "/var/run/linkerd-cni/metadata.sock")
+			},
+		},
 		{
 			name: "FileSourceNotSet",
 			sources: []source{
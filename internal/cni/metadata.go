@@ -0,0 +1,44 @@
+package cni
+
+import (
+	"context"
+	"errors"
+
+	"github.com/linkerd/linkerd2-proxy-init/internal/metadata"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// runMetadataCache serves the metadata of the pods of the node to the plugin
+// over the socket at METADATA_CACHE_SOCKET, until the context is done. It is
+// a noop when the socket isn't configured. Since the plugin falls back to the
+// API server when the cache is unavailable, failures are only logged.
+func runMetadataCache(ctx context.Context) {
+	socket := hostMetadataCacheSocket()
+	if socket == "" {
+		return
+	}
+	if nodeName.get() == "" {
+		log.Errorf("cannot run the metadata cache: %s is not set", nodeName.key)
+		return
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.WithError(err).Error("cannot run the metadata cache")
+		return
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.WithError(err).Error("cannot run the metadata cache")
+		return
+	}
+
+	go func() {
+		err := metadata.NewServer(client, nodeName.get()).Run(ctx, socket)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.WithError(err).Error("metadata cache stopped")
+		}
+	}()
+}
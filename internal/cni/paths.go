@@ -13,6 +13,8 @@ var (
 	containerMountPrefix  = envVar{key: "CONTAINER_MOUNT_PREFIX", defaultVal: "/host"}
 	kubeCAFile            = envVar{key: "KUBE_CA_FILE", defaultVal: ""}
 	kubeConfigFilenameVar = envVar{key: "KUBECONFIG_FILE_NAME", defaultVal: "ZZZ-linkerd-cni-kubeconfig"}
+	metadataCacheSocket   = envVar{key: "METADATA_CACHE_SOCKET", defaultVal: ""}
+	nodeName              = envVar{key: "NODE_NAME", defaultVal: ""}
 	svcHost               = envVar{key: "KUBERNETES_SERVICE_HOST", defaultVal: ""}
 	svcPort               = envVar{key: "KUBERNETES_SERVICE_PORT", defaultVal: ""}
 )
@@ -43,6 +45,15 @@ func pluginKubeConfigFilename() string {
 	return path.Join(cniConfigDir.get(), kubeConfigFilenameVar.get())
 }
 
+// hostMetadataCacheSocket returns the host path at which the metadata cache
+// listens, or an empty string when the cache is disabled.
+func hostMetadataCacheSocket() string {
+	if metadataCacheSocket.get() == "" {
+		return ""
+	}
+	return path.Join(containerMountPrefix.get(), metadataCacheSocket.get())
+}
+
 // envVar combines an environment variable name (key) and a default value.
 type envVar struct {
 	key        string
@@ -23,6 +23,9 @@ import (
 // account token file, as well as the cni configuration root. If events for
 // either watch fire the corresponding configuration is rewritten.
 //
+// When METADATA_CACHE_SOCKET is set, it also serves the metadata of the pods
+// of the node to the plugin from a cache, over a unix socket.
+//
 // If an error occurs it is returned.
 func (i *installer) Run(ctx context.Context) error {
 	installed, err := i.installRegularFiles(hostCNIBin(),
@@ -86,6 +89,7 @@ func (i *installer) Run(ctx context.Context) error {
 	errs := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	runMetadataCache(ctx)
 	err = i.watchFS(ctx, errs, watches)
 	if err != nil {
 		return err
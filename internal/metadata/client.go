@@ -0,0 +1,95 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// clientTimeout bounds the requests to the cache, so that an unresponsive
+// daemon doesn't hold the pod sandbox creation for long.
+const clientTimeout = 2 * time.Second
+
+// ErrNotFound is returned when the object isn't cached, either because it
+// doesn't exist or because the cache didn't catch up with it yet.
+var ErrNotFound = errors.New("not found in the metadata cache")
+
+// Client fetches the cached metadata from the server listening on a unix
+// socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client of the server listening on socket.
+func NewClient(socket string) *Client {
+	dialer := &net.Dialer{}
+	return &Client{
+		http: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Pod returns the cached pod.
+func (c *Client) Pod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	pod := &v1.Pod{}
+	if err := c.get(ctx, podsPath+namespace+"/"+name, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// Namespace returns the cached namespace.
+func (c *Client) Namespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns := &v1.Namespace{}
+	if err := c.get(ctx, namespacesPath+name, ns); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Service returns the cached service. Only the kubernetes service of the
+// default namespace is cached.
+func (c *Client) Service(ctx context.Context, namespace, name string) (*v1.Service, error) {
+	service := &v1.Service{}
+	if err := c.get(ctx, servicesPath+namespace+"/"+name, service); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, obj any) error {
+	// the host is ignored when dialing the socket
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(obj)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w", path, ErrNotFound)
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected status %d from the metadata cache: %s", path, resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServer(t *testing.T) {
+	clientset := fake.NewClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:          "pod",
+				Namespace:     "emojivoto",
+				Annotations:   map[string]string{"config.linkerd.io/skip-inbound-ports": "4190"},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+			},
+			Spec: v1.PodSpec{
+				NodeName:   "node",
+				Containers: []v1.Container{{Name: "linkerd-proxy"}},
+			},
+		},
+		&v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "emojivoto",
+				Annotations: map[string]string{"config.linkerd.io/skip-subnets": "10.0.0.0/8"},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: "default"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 443}}},
+		},
+	)
+
+	// unix socket paths are limited to about a hundred characters, which the
+	// test temporary directory can exceed
+	dir, err := os.MkdirTemp("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "metadata.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- NewServer(clientset, "node").Run(ctx, socket)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error from the server: %s", err)
+		}
+	}()
+
+	client := NewClient(socket)
+	deadline := time.Now().Add(5 * time.Second)
+	var pod *v1.Pod
+	for {
+		pod, err = client.Pod(ctx, "emojivoto", "pod")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("cannot get the cached pod: %s", err)
+	}
+	if pod.Annotations["config.linkerd.io/skip-inbound-ports"] != "4190" || pod.Spec.Containers[0].Name != "linkerd-proxy" {
+		t.Fatalf("unexpected cached pod %+v", pod)
+	}
+	if len(pod.ManagedFields) != 0 {
+		t.Fatalf("expected the managed fields to be stripped, got %v", pod.ManagedFields)
+	}
+
+	ns, err := client.Namespace(ctx, "emojivoto")
+	if err != nil {
+		t.Fatalf("cannot get the cached namespace: %s", err)
+	}
+	if ns.Annotations["config.linkerd.io/skip-subnets"] != "10.0.0.0/8" {
+		t.Fatalf("unexpected cached namespace %+v", ns)
+	}
+
+	service, err := client.Service(ctx, "default", "kubernetes")
+	if err != nil {
+		t.Fatalf("cannot get the cached service: %s", err)
+	}
+	if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].Port != 443 {
+		t.Fatalf("unexpected cached service %+v", service)
+	}
+
+	if _, err := client.Pod(ctx, "emojivoto", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing pod, got %v", err)
+	}
+}
+
+func TestClient_Unavailable(t *testing.T) {
+	client := NewClient(path.Join(t.TempDir(), "missing.sock"))
+	_, err := client.Namespace(context.Background(), "default")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+}
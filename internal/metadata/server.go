@@ -0,0 +1,171 @@
+// Package metadata serves the pod, namespace and service metadata needed by
+// the linkerd-cni plugin from a node-local cache, backed by informers, over a
+// unix socket. This spares the API server the requests the plugin would
+// otherwise issue on every invocation.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// apiServerNamespace and apiServerService name the service exposing the
+	// API server, whose ports are skipped by the control plane pods.
+	apiServerNamespace = "default"
+	apiServerService   = "kubernetes"
+
+	// socketPerm restricts the socket to root, like the plugin itself.
+	socketPerm = 0600
+
+	// podsPath, namespacesPath and servicesPath prefix the paths of the
+	// cached objects.
+	podsPath       = "/v1/pods/"
+	namespacesPath = "/v1/namespaces/"
+	servicesPath   = "/v1/services/"
+)
+
+// Server serves the metadata of the pods scheduled on a node, of all the
+// namespaces and of the kubernetes service.
+type Server struct {
+	pods       listersv1.PodLister
+	namespaces listersv1.NamespaceLister
+	services   listersv1.ServiceLister
+	synced     []cache.InformerSynced
+	factories  []informers.SharedInformerFactory
+}
+
+// NewServer returns a server caching the metadata of the pods scheduled on
+// nodeName. The informers only start with Run.
+func NewServer(client kubernetes.Interface, nodeName string) *Server {
+	podFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}),
+		informers.WithTransform(stripManagedFields))
+	namespaceFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTransform(stripManagedFields))
+	serviceFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(apiServerNamespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", apiServerService).String()
+		}),
+		informers.WithTransform(stripManagedFields))
+
+	pods := podFactory.Core().V1().Pods()
+	namespaces := namespaceFactory.Core().V1().Namespaces()
+	services := serviceFactory.Core().V1().Services()
+
+	return &Server{
+		pods:       pods.Lister(),
+		namespaces: namespaces.Lister(),
+		services:   services.Lister(),
+		synced: []cache.InformerSynced{
+			pods.Informer().HasSynced,
+			namespaces.Informer().HasSynced,
+			services.Informer().HasSynced,
+		},
+		factories: []informers.SharedInformerFactory{podFactory, namespaceFactory, serviceFactory},
+	}
+}
+
+// Run starts the informers and, once they are synced, serves the metadata on
+// the unix socket until the context is done. A stale socket left by a
+// previous run is replaced.
+func (s *Server) Run(ctx context.Context, socket string) error {
+	for _, factory := range s.factories {
+		factory.Start(ctx.Done())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), s.synced...) {
+		return fmt.Errorf("cannot sync the metadata cache: %w", ctx.Err())
+	}
+
+	if err := os.MkdirAll(path.Dir(socket), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	if err := os.Chmod(socket, socketPerm); err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.WithField("socket", socket).Info("serving the metadata cache")
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the handler serving the cached objects as JSON, answering
+// with 404 when they aren't cached.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+podsPath+"{namespace}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		pod, err := s.pods.Pods(r.PathValue("namespace")).Get(r.PathValue("name"))
+		writeObject(w, r, pod, err)
+	})
+	mux.HandleFunc("GET "+namespacesPath+"{name}", func(w http.ResponseWriter, r *http.Request) {
+		ns, err := s.namespaces.Get(r.PathValue("name"))
+		writeObject(w, r, ns, err)
+	})
+	mux.HandleFunc("GET "+servicesPath+"{namespace}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		service, err := s.services.Services(r.PathValue("namespace")).Get(r.PathValue("name"))
+		writeObject(w, r, service, err)
+	})
+	return mux
+}
+
+func writeObject(w http.ResponseWriter, r *http.Request, obj any, err error) {
+	if apierrors.IsNotFound(err) {
+		log.WithField("path", r.URL.Path).Debug("metadata cache miss")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.WithError(err).Error("cannot write the cached metadata")
+	}
+}
+
+// stripManagedFields drops the managed fields of the cached objects, which
+// the plugin doesn't need, to keep the cache small.
+func stripManagedFields(obj any) (any, error) {
+	if accessor, ok := obj.(metav1.ObjectMetaAccessor); ok {
+		accessor.GetObjectMeta().SetManagedFields(nil)
+	}
+	return obj, nil
+}
@@ -0,0 +1,344 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backend applies the Ruleset built from a FirewallConfiguration. Besides the
+// iptables, iptables-restore and nftables backends provided by this package,
+// callers can provide their own implementation through
+// FirewallConfiguration.Backend, e.g. to record or audit the changes.
+type Backend interface {
+	// Configure installs the sets, chains and routes of the ruleset. The
+	// rules of any chain and the elements of any set already present are
+	// replaced, while jumps already present are kept.
+	Configure(ruleset *Ruleset) error
+
+	// Cleanup removes the chains of the ruleset, along with their jumps, sets
+	// and routes. Chains, jumps, sets and routes already absent are skipped.
+	Cleanup(ruleset *Ruleset) error
+
+	// Verify compares the installed rules against the ruleset, returning the
+	// differences found in its chains and jumps. Routes and the elements of
+	// sets are not verified.
+	Verify(ruleset *Ruleset) ([]Drift, error)
+}
+
+// NewExecBackend returns a Backend running a separate iptables command for
+// every change, using the binaries, network namespace and flags of the
+// provided configuration.
+func NewExecBackend(fc FirewallConfiguration) Backend {
+	return &execBackend{fc: fc}
+}
+
+// NewRestoreBackend returns a Backend applying all the changes to a table in
+// a single iptables-restore transaction. Cleanup runs separate iptables
+// commands, so it can proceed when some of the chains are already gone.
+func NewRestoreBackend(fc FirewallConfiguration) Backend {
+	return &restoreBackend{execBackend{fc: fc}}
+}
+
+type execBackend struct {
+	fc FirewallConfiguration
+}
+
+type restoreBackend struct {
+	execBackend
+}
+
+// Configure implements Backend.
+func (b *execBackend) Configure(ruleset *Ruleset) error {
+	// Before executing, ensure the configured iptables binaries exist; if not, attempt a fallback.
+	resolveBinFallback(&b.fc, exec.LookPath)
+
+	existingRules, err := b.showAllRules(ruleset)
+	if err != nil {
+		log.Error("aborting firewall configuration")
+		return err
+	}
+
+	if err := configureSets(b.fc, ruleset.Sets); err != nil {
+		return err
+	}
+
+	if err := b.executeCommands(b.configureCommands(ruleset, existingRules)); err != nil {
+		return err
+	}
+
+	if err := configureRoutes(b.fc, ruleset.Routes); err != nil {
+		return err
+	}
+
+	_, _ = b.showAllRules(ruleset)
+
+	return nil
+}
+
+// Cleanup implements Backend. Only the jumps and chains present are removed,
+// so it can complete a previous, partial cleanup.
+func (b *execBackend) Cleanup(ruleset *Ruleset) error {
+	log.Debugf("using '%s' to clean-up firewall rules", b.fc.BinPath)
+	log.Debugf("using '%s' to list all available rules", b.fc.SaveBinPath)
+
+	// Ensure binaries exist before attempting cleanup as well
+	resolveBinFallback(&b.fc, exec.LookPath)
+
+	existingRules, err := b.showAllRules(ruleset)
+	if err != nil {
+		log.Error("aborting firewall cleanup")
+		return err
+	}
+
+	// when simulating, the current rules are unknown
+	if b.fc.SimulateOnly {
+		existingRules = nil
+	}
+
+	commands, removed := b.cleanupCommands(ruleset, existingRules)
+	if err := b.executeCommands(commands); err != nil {
+		return err
+	}
+
+	cleanupSets(b.fc, ruleset.Sets)
+
+	cleanupRoutes(b.fc, ruleset.Routes)
+
+	if len(removed) == 0 {
+		log.Info("no proxy-init rules found, nothing to clean up")
+	}
+	for _, r := range removed {
+		if b.fc.SimulateOnly {
+			log.Infof("would remove %s", r)
+		} else {
+			log.Infof("removed %s", r)
+		}
+	}
+
+	_, _ = b.showAllRules(ruleset)
+
+	return nil
+}
+
+// Verify implements Backend.
+func (b *execBackend) Verify(ruleset *Ruleset) ([]Drift, error) {
+	resolveBinFallback(&b.fc, exec.LookPath)
+
+	existingRules, err := b.showAllRules(ruleset)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.fc.SimulateOnly {
+		return nil, nil
+	}
+
+	return verifySaveOutput(ruleset, existingRules), nil
+}
+
+// Configure implements Backend.
+func (b *restoreBackend) Configure(ruleset *Ruleset) error {
+	resolveBinFallback(&b.fc, exec.LookPath)
+
+	existingRules, err := b.showAllRules(ruleset)
+	if err != nil {
+		log.Error("aborting firewall configuration")
+		return err
+	}
+
+	if err := configureSets(b.fc, ruleset.Sets); err != nil {
+		return err
+	}
+
+	// All the changes are applied as a single iptables-restore transaction,
+	// so a failure never leaves the chains partially configured.
+	payload := makeRestorePayload(ruleset, existingRules)
+
+	cmd := b.fc.makeRestore(payload)
+	if b.fc.UseWaitFlag {
+		log.Debug("'useWaitFlag' set: iptables-restore will wait for xtables to become available")
+		cmd.Args = append(cmd.Args, "-w")
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(payload), "\n") {
+		log.Info(line)
+	}
+
+	if _, err := executeCommand(b.fc, cmd); err != nil {
+		if !b.fc.ContinueOnError {
+			return err
+		}
+
+		log.Debugf("continuing despite error: %s", err)
+	}
+
+	if err := configureRoutes(b.fc, ruleset.Routes); err != nil {
+		return err
+	}
+
+	_, _ = b.showAllRules(ruleset)
+
+	return nil
+}
+
+// showAllRules returns the output of iptables-save for each of the tables of
+// the ruleset, indexed by table name.
+func (b *execBackend) showAllRules(ruleset *Ruleset) (map[string][]byte, error) {
+	existingRules := map[string][]byte{}
+	for _, table := range ruleset.Tables() {
+		out, err := executeCommand(b.fc, b.fc.makeShowAllRules(table))
+		if err != nil {
+			return nil, err
+		}
+		existingRules[table] = out
+	}
+	return existingRules, nil
+}
+
+func (b *execBackend) executeCommands(commands []*exec.Cmd) error {
+	if b.fc.UseWaitFlag {
+		log.Debug("'useWaitFlag' set: iptables will wait for xtables to become available")
+	}
+
+	for _, cmd := range commands {
+		if b.fc.UseWaitFlag {
+			cmd.Args = append(cmd.Args, "-w")
+		}
+
+		if _, err := executeCommand(b.fc, cmd); err != nil {
+			if !b.fc.ContinueOnError {
+				return err
+			}
+
+			log.Debugf("continuing despite error: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// configureCommands returns the commands creating (or flushing, when they
+// already exist) the chains of the ruleset, appending their rules, and
+// installing their jumps when missing.
+func (b *execBackend) configureCommands(ruleset *Ruleset, existingRules map[string][]byte) []*exec.Cmd {
+	commands := make([]*exec.Cmd, 0)
+	for _, chain := range ruleset.Chains {
+		if chainExists(existingRules[chain.Table], chain.Name) {
+			commands = append(commands, b.fc.makeFlushChain(chain.Table, chain.Name))
+		} else {
+			commands = append(commands, b.fc.makeCreateNewChain(chain.Table, chain.Name))
+		}
+
+		for _, rule := range chain.Rules {
+			commands = append(commands, b.fc.makeRule(chain.Table, "-A", rule))
+		}
+
+		if !jumpExists(existingRules[chain.Table], chain.Jump) {
+			commands = append(commands, b.fc.makeRule(chain.Table, "-A", chain.Jump))
+		}
+	}
+	return commands
+}
+
+// cleanupCommands returns the commands removing the jumps to the chains of
+// the ruleset, and then flushing and deleting those chains, along with a
+// description of what they remove. Jumps are deleted by rule number, in
+// reverse order, so duplicated and outdated jumps are removed as well. When
+// existingRules is nil, the current rules are assumed to be unknown and all
+// the commands are returned.
+func (b *execBackend) cleanupCommands(ruleset *Ruleset, existingRules map[string][]byte) ([]*exec.Cmd, []string) {
+	commands := make([]*exec.Cmd, 0)
+	removed := make([]string, 0)
+	for _, chain := range ruleset.Chains {
+		if existingRules == nil {
+			commands = append(commands, b.fc.makeRule(chain.Table, "-D", chain.Jump))
+			removed = append(removed, fmt.Sprintf("jump from %s to %s in table %s", chain.Jump.Chain, chain.Name, chain.Table))
+			continue
+		}
+
+		jumps := jumpRuleNumbers(existingRules[chain.Table], chain.Jump)
+		for i := len(jumps) - 1; i >= 0; i-- {
+			commands = append(commands, b.fc.makeDeleteRuleNum(chain.Table, chain.Jump.Chain, jumps[i]))
+			removed = append(removed, fmt.Sprintf("jump from %s to %s in table %s", chain.Jump.Chain, chain.Name, chain.Table))
+		}
+	}
+
+	chains := make([]Chain, 0)
+	for i := len(ruleset.Chains) - 1; i >= 0; i-- {
+		if existingRules == nil || chainExists(existingRules[ruleset.Chains[i].Table], ruleset.Chains[i].Name) {
+			chains = append(chains, ruleset.Chains[i])
+		}
+	}
+
+	for _, chain := range chains {
+		commands = append(commands, b.fc.makeFlushChain(chain.Table, chain.Name))
+	}
+
+	for _, chain := range chains {
+		commands = append(commands, b.fc.makeDeleteChain(chain.Table, chain.Name))
+		removed = append(removed, fmt.Sprintf("chain %s from table %s", chain.Name, chain.Table))
+	}
+
+	return commands, removed
+}
+
+// makeRestorePayload renders the ruleset into an iptables-restore payload.
+// Chains are declared, which creates them or flushes them if they already
+// exist when restoring with --noflush.
+func makeRestorePayload(ruleset *Ruleset, existingRules map[string][]byte) string {
+	var payload strings.Builder
+	for _, table := range ruleset.Tables() {
+		fmt.Fprintf(&payload, "*%s\n", table)
+		for _, chain := range ruleset.Chains {
+			if chain.Table == table {
+				fmt.Fprintf(&payload, ":%s - [0:0]\n", chain.Name)
+			}
+		}
+		for _, chain := range ruleset.Chains {
+			if chain.Table != table {
+				continue
+			}
+			for _, rule := range chain.Rules {
+				fmt.Fprintf(&payload, "%s\n", rule)
+			}
+			if !jumpExists(existingRules[table], chain.Jump) {
+				fmt.Fprintf(&payload, "%s\n", chain.Jump)
+			}
+		}
+		payload.WriteString("COMMIT\n")
+	}
+	return payload.String()
+}
+
+// chainExists reports whether the iptables-save output declares the chain.
+func chainExists(existingRules []byte, name string) bool {
+	return regexp.MustCompile(fmt.Sprintf(`(?m)^:%s `, regexp.QuoteMeta(name))).Match(existingRules)
+}
+
+// jumpRuleNumbers returns the positions, starting at 1, of the rules of the
+// iptables-save output in the same chain and with the same target as the
+// provided jump.
+func jumpRuleNumbers(existingRules []byte, jump Rule) []int {
+	numbers := make([]int, 0)
+	n := 0
+	for _, line := range savedRules(existingRules) {
+		if !strings.HasPrefix(line, fmt.Sprintf("-A %s ", jump.Chain)) {
+			continue
+		}
+		n++
+		if jumpExists([]byte(line), jump) {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+// jumpExists reports whether the iptables-save output holds a rule in the
+// same chain and with the same target as the provided jump.
+func jumpExists(existingRules []byte, jump Rule) bool {
+	return regexp.MustCompile(fmt.Sprintf(`(?m)^-A %s (.+ )?-j %s( |$)`, regexp.QuoteMeta(jump.Chain), regexp.QuoteMeta(jump.Target))).Match(existingRules)
+}
@@ -0,0 +1,154 @@
+package iptables
+
+import (
+	"reflect"
+)
+
+// FakeBackend is an in-memory Backend meant to be used in tests. It keeps
+// track of the chains and rules the applied rulesets would result in.
+type FakeBackend struct {
+	// Tables holds the rules of every chain, indexed by table and chain name.
+	// Builtin chains only hold the jumps installed by proxy-init.
+	Tables map[string]map[string][]Rule
+
+	// Routes holds the installed policy routes.
+	Routes []PolicyRoute
+
+	// Sets holds the installed sets, indexed by name.
+	Sets map[string]Set
+
+	// ConfigureErr, when set, is returned by Configure without applying any
+	// change.
+	ConfigureErr error
+
+	// CleanupErr, when set, is returned by Cleanup without applying any
+	// change.
+	CleanupErr error
+
+	// VerifyErr, when set, is returned by Verify.
+	VerifyErr error
+}
+
+// NewFakeBackend returns an empty FakeBackend.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{Tables: map[string]map[string][]Rule{}}
+}
+
+// Configure implements Backend.
+func (b *FakeBackend) Configure(ruleset *Ruleset) error {
+	if b.ConfigureErr != nil {
+		return b.ConfigureErr
+	}
+
+	for _, chain := range ruleset.Chains {
+		table := b.table(chain.Table)
+		table[chain.Name] = append([]Rule{}, chain.Rules...)
+		if indexOfRule(table[chain.Jump.Chain], chain.Jump) < 0 {
+			table[chain.Jump.Chain] = append(table[chain.Jump.Chain], chain.Jump)
+		}
+	}
+
+	for _, set := range ruleset.Sets {
+		if b.Sets == nil {
+			b.Sets = map[string]Set{}
+		}
+		b.Sets[set.Name] = set
+	}
+
+	for _, route := range ruleset.Routes {
+		if indexOfRoute(b.Routes, route) < 0 {
+			b.Routes = append(b.Routes, route)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup implements Backend.
+func (b *FakeBackend) Cleanup(ruleset *Ruleset) error {
+	if b.CleanupErr != nil {
+		return b.CleanupErr
+	}
+
+	for _, chain := range ruleset.Chains {
+		table := b.table(chain.Table)
+		if i := indexOfRule(table[chain.Jump.Chain], chain.Jump); i >= 0 {
+			table[chain.Jump.Chain] = append(table[chain.Jump.Chain][:i], table[chain.Jump.Chain][i+1:]...)
+		}
+		if len(table[chain.Jump.Chain]) == 0 {
+			delete(table, chain.Jump.Chain)
+		}
+		delete(table, chain.Name)
+	}
+
+	for _, set := range ruleset.Sets {
+		delete(b.Sets, set.Name)
+	}
+
+	for _, route := range ruleset.Routes {
+		if i := indexOfRoute(b.Routes, route); i >= 0 {
+			b.Routes = append(b.Routes[:i], b.Routes[i+1:]...)
+		}
+	}
+
+	return nil
+}
+
+// Verify implements Backend.
+func (b *FakeBackend) Verify(ruleset *Ruleset) ([]Drift, error) {
+	if b.VerifyErr != nil {
+		return nil, b.VerifyErr
+	}
+
+	drifts := make([]Drift, 0)
+	for _, chain := range ruleset.Chains {
+		table := b.table(chain.Table)
+		drifts = append(drifts, diffRules(chain.Table, chain.Name, ruleStrings(chain.Rules), ruleStrings(table[chain.Name]))...)
+
+		jumps := make([]Rule, 0)
+		for _, rule := range table[chain.Jump.Chain] {
+			if rule.Target == chain.Jump.Target {
+				jumps = append(jumps, rule)
+			}
+		}
+		drifts = append(drifts, diffRules(chain.Table, chain.Jump.Chain, ruleStrings([]Rule{chain.Jump}), ruleStrings(jumps))...)
+	}
+
+	return drifts, nil
+}
+
+func (b *FakeBackend) table(name string) map[string][]Rule {
+	if b.Tables == nil {
+		b.Tables = map[string]map[string][]Rule{}
+	}
+	if _, ok := b.Tables[name]; !ok {
+		b.Tables[name] = map[string][]Rule{}
+	}
+	return b.Tables[name]
+}
+
+func indexOfRule(rules []Rule, rule Rule) int {
+	for i := range rules {
+		if reflect.DeepEqual(rules[i], rule) {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexOfRoute(routes []PolicyRoute, route PolicyRoute) int {
+	for i := range routes {
+		if routes[i] == route {
+			return i
+		}
+	}
+	return -1
+}
+
+func ruleStrings(rules []Rule) []string {
+	strs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		strs = append(strs, rule.String())
+	}
+	return strs
+}
@@ -2,8 +2,9 @@ package iptables
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -27,20 +28,32 @@ const (
 	// IptablesOutputChainName specifies an iptables `OUTPUT` chain.
 	IptablesOutputChainName = "OUTPUT"
 
+	// InboundInterceptionModeRedirect indicates redirecting inbound traffic
+	// to the proxy with nat REDIRECT, which rewrites the destination address.
+	InboundInterceptionModeRedirect = "redirect"
+
+	// InboundInterceptionModeTProxy indicates delivering inbound traffic to
+	// the proxy with mangle TPROXY, which preserves the destination address.
+	InboundInterceptionModeTProxy = "tproxy"
+
+	// DefaultTProxyMark is the fwmark set on the packets intercepted in
+	// InboundInterceptionModeTProxy, when none is configured.
+	DefaultTProxyMark = 0x539
+
+	// DefaultTProxyRouteTable is the routing table delivering the packets
+	// carrying the TPROXY fwmark locally, when none is configured.
+	DefaultTProxyRouteTable = 133
+
 	// IptablesMultiportLimit specifies the maximum number of port references per single iptables command.
 	IptablesMultiportLimit = 15
 	outputChainName        = "PROXY_INIT_OUTPUT"
 	redirectChainName      = "PROXY_INIT_REDIRECT"
+	tproxyChainName        = "PROXY_INIT_TPROXY"
 )
 
 var (
 	// ExecutionTraceID provides a unique identifier for this script's execution.
 	executionTraceID = strconv.Itoa(int(time.Now().Unix()))
-
-	preroutingRuleRegex = regexp.MustCompile(`(?m)^-A PREROUTING (.+ )?-j PROXY_INIT_REDIRECT`)
-	outputRuleRegex     = regexp.MustCompile(`(?m)^-A OUTPUT (.+ )?-j PROXY_INIT_OUTPUT`)
-	redirectChainRegex  = regexp.MustCompile(`(?m)^:PROXY_INIT_REDIRECT `)
-	outputChainRegex    = regexp.MustCompile(`(?m)^:PROXY_INIT_OUTPUT `)
 )
 
 // FirewallConfiguration specifies how to configure iptables.
@@ -50,16 +63,57 @@ type FirewallConfiguration struct {
 	InboundPortsToIgnore   []string
 	OutboundPortsToIgnore  []string
 	SubnetsToIgnore        []string
-	ProxyInboundPort       int
-	ProxyOutgoingPort      int
-	ProxyUID               int
-	ProxyGID               int
-	SimulateOnly           bool
-	NetNs                  string
-	UseWaitFlag            bool
-	BinPath                string
-	SaveBinPath            string
-	ContinueOnError        bool
+	// InboundPortsToIgnoreFromSubnets are inbound ports and port ranges only
+	// ignored for the traffic coming from a subnet, as
+	// <port or range>@<subnet>.
+	InboundPortsToIgnoreFromSubnets []string
+	// OutboundSubnetsToIgnore are the destination subnets outbound traffic
+	// is not redirected for, unlike SubnetsToIgnore which match the source
+	// of inbound traffic.
+	OutboundSubnetsToIgnore []string
+	ProxyInboundPort        int
+	ProxyOutgoingPort       int
+	ProxyUID                int
+	ProxyGID                int
+	SimulateOnly            bool
+	NetNs                   string
+	UseWaitFlag             bool
+	BinPath                 string
+	SaveBinPath             string
+	RestoreBinPath          string
+	ContinueOnError         bool
+	NFTables                bool
+	IPv6                    bool
+	// ProxyOutboundDNSPort, when set, is the port DNS traffic sent to port 53
+	// over UDP and TCP is redirected to.
+	ProxyOutboundDNSPort int
+	// InboundInterceptionMode is either InboundInterceptionModeRedirect (the
+	// default, when empty) or InboundInterceptionModeTProxy.
+	InboundInterceptionMode string
+	// TProxyMark and TProxyRouteTable are the fwmark and routing table used
+	// in InboundInterceptionModeTProxy; defaults apply when zero.
+	TProxyMark       int
+	TProxyRouteTable int
+	// ProxyCgroupPath, when set, is the cgroup v2 path of the proxy,
+	// relative to the root of the cgroup hierarchy. Traffic from that cgroup
+	// is ignored like traffic from ProxyUID and ProxyGID, which lets
+	// workloads share the proxy user. Both iptables and nftables resolve the
+	// cgroup when the rules are installed, so it must already exist then:
+	// this rules out the cgroup of a proxy container, only created by the
+	// runtime after the pod network is set up, for which ProxyMark should be
+	// used instead.
+	ProxyCgroupPath string
+	// UseSets holds the ignored ports and subnets in sets, ipsets or
+	// nftables sets depending on the backend, matched by a single rule each
+	// instead of one rule per subnet and group of ports.
+	UseSets bool
+	// ProxyMark, when set, is the fwmark the proxy sets through SO_MARK on
+	// the outbound connections that must not be redirected back to it.
+	ProxyMark int
+	// Backend overrides the backend used to apply the rules, which otherwise
+	// is the nftables backend when NFTables is set, or the iptables-restore
+	// backend.
+	Backend Backend
 }
 
 // ConfigureFirewall configures iptables to redirect all desired traffic through the proxy, allowing for
@@ -68,213 +122,49 @@ type FirewallConfiguration struct {
 func ConfigureFirewall(firewallConfiguration FirewallConfiguration) error {
 	log.Debugf("tracing script execution as [%s]", executionTraceID)
 
-	// Before executing, ensure the configured iptables binaries exist; if not, attempt a fallback.
-	resolveBinFallback(&firewallConfiguration, exec.LookPath)
-
-	existingRules, err := executeCommand(firewallConfiguration, firewallConfiguration.makeShowAllRules())
-	if err != nil {
-		log.Error("aborting firewall configuration")
-		return err
-	}
-
-	commands := make([]*exec.Cmd, 0)
-
-	commands = firewallConfiguration.addIncomingTrafficRules(existingRules, commands)
-
-	commands = firewallConfiguration.addOutgoingTrafficRules(existingRules, commands)
-
-	if firewallConfiguration.UseWaitFlag {
-		log.Debug("'useWaitFlag' set: iptables will wait for xtables to become available")
-	}
-
-	for _, cmd := range commands {
-		if firewallConfiguration.UseWaitFlag {
-			cmd.Args = append(cmd.Args, "-w")
-		}
-
-		if _, err := executeCommand(firewallConfiguration, cmd); err != nil {
-			if !firewallConfiguration.ContinueOnError {
-				return err
-			}
-
-			log.Debugf("continuing despite error: %s", err)
+	if firewallConfiguration.ProxyCgroupPath != "" && !firewallConfiguration.SimulateOnly {
+		if err := checkCgroupPath(firewallConfiguration.ProxyCgroupPath); err != nil {
+			return err
 		}
 	}
 
-	_, _ = executeCommand(firewallConfiguration, firewallConfiguration.makeShowAllRules())
-
-	return nil
+	return firewallConfiguration.backend().Configure(firewallConfiguration.Ruleset())
 }
 
 // CleanupFirewallConfig removes the iptables rules that have been added as a result of
 // calling ConfigureFirewall.
 func CleanupFirewallConfig(firewallConfiguration FirewallConfiguration) error {
 	log.Debugf("tracing script execution as [%s]", executionTraceID)
-	log.Debugf("using '%s' to clean-up firewall rules", firewallConfiguration.BinPath)
-	log.Debugf("using '%s' to list all available rules", firewallConfiguration.SaveBinPath)
-
-	// Ensure binaries exist before attempting cleanup as well
-	resolveBinFallback(&firewallConfiguration, exec.LookPath)
 
-	commands := make([]*exec.Cmd, 0)
-	commands = firewallConfiguration.cleanupRules(commands)
-
-	if firewallConfiguration.UseWaitFlag {
-		log.Debug("'useWaitFlag' set: iptables will wait for xtables to become available")
-	}
-
-	for _, cmd := range commands {
-		if firewallConfiguration.UseWaitFlag {
-			cmd.Args = append(cmd.Args, "-w")
-		}
-
-		if _, err := executeCommand(firewallConfiguration, cmd); err != nil {
-			if !firewallConfiguration.ContinueOnError {
-				return err
-			}
-
-			log.Debugf("continuing despite error: %s", err)
-		}
-	}
-
-	_, _ = executeCommand(firewallConfiguration, firewallConfiguration.makeShowAllRules())
-
-	return nil
+	return firewallConfiguration.backend().Cleanup(firewallConfiguration.Ruleset())
 }
 
-func (fc FirewallConfiguration) cleanupRules(commands []*exec.Cmd) []*exec.Cmd {
-	// delete ref from prerouting
-	commands = append(
-		commands,
-		fc.makeJumpFromChainToAnotherForAllProtocols(
-			IptablesPreroutingChainName,
-			redirectChainName,
-			"install-proxy-init-prerouting",
-			true))
-
-	// delete ref from output
-	commands = append(
-		commands,
-		fc.makeJumpFromChainToAnotherForAllProtocols(
-			IptablesOutputChainName,
-			outputChainName,
-			"install-proxy-init-output",
-			true))
-
-	// flush chains
-	commands = append(commands, fc.makeFlushChain(outputChainName))
-	commands = append(commands, fc.makeFlushChain(redirectChainName))
-
-	// delete chains
-	commands = append(commands, fc.makeDeleteChain(outputChainName))
-	commands = append(commands, fc.makeDeleteChain(redirectChainName))
-
-	return commands
-}
-
-// formatComment is used to format iptables comments
-func formatComment(text string) string {
-	return fmt.Sprintf("proxy-init/%s", text)
-}
-
-func (fc FirewallConfiguration) addOutgoingTrafficRules(existingRules []byte, commands []*exec.Cmd) []*exec.Cmd {
-	if outputChainRegex.Find(existingRules) == nil {
-		commands = append(commands, fc.makeCreateNewChain(outputChainName))
-	} else {
-		commands = append(commands, fc.makeFlushChain(outputChainName))
-	}
-
-	// Ignore traffic from the proxy
-	if fc.ProxyUID > 0 {
-		commands = append(commands, fc.makeIgnoreUserID(outputChainName, fc.ProxyUID, "ignore-proxy-user-id"))
-	}
-
-	// Ignore traffic from the proxy
-	if fc.ProxyGID > 0 {
-		commands = append(commands, fc.makeIgnoreGroupID(outputChainName, fc.ProxyGID, "ignore-proxy-group-id"))
-	}
-
-	// Ignore loopback
-	commands = append(commands, fc.makeIgnoreLoopback(outputChainName, "ignore-loopback"))
-	// Ignore ports
-	commands = fc.addRulesForIgnoredPorts(fc.OutboundPortsToIgnore, outputChainName, commands)
-
-	commands = append(commands, fc.makeRedirectChainToPort(outputChainName, fc.ProxyOutgoingPort, "redirect-all-outgoing-to-proxy-port"))
-
-	if outputRuleRegex.Find(existingRules) == nil {
-		// Redirect all remaining outbound traffic to the proxy.
-		commands = append(
-			commands,
-			fc.makeJumpFromChainToAnotherForAllProtocols(
-				IptablesOutputChainName,
-				outputChainName,
-				"install-proxy-init-output",
-				false))
+// checkCgroupPath makes sure the proxy cgroup exists, reporting the mistake
+// of pointing at a cgroup created later, like the one of a proxy container,
+// before any rule is installed.
+func checkCgroupPath(path string) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, path)); err != nil {
+		return fmt.Errorf("the proxy cgroup %s must exist when the rules are installed, use the proxy mark for proxies started afterwards: %w", path, err)
 	}
 
-	return commands
-}
-
-func (fc FirewallConfiguration) addIncomingTrafficRules(existingRules []byte, commands []*exec.Cmd) []*exec.Cmd {
-	if redirectChainRegex.Find(existingRules) == nil {
-		commands = append(commands, fc.makeCreateNewChain(redirectChainName))
-	} else {
-		commands = append(commands, fc.makeFlushChain(redirectChainName))
-	}
-	commands = fc.addRulesForIgnoredPorts(fc.InboundPortsToIgnore, redirectChainName, commands)
-	commands = fc.addRulesForIgnoredSubnets(redirectChainName, commands)
-	commands = fc.addRulesForInboundPortRedirect(redirectChainName, commands)
-
-	if preroutingRuleRegex.Find(existingRules) == nil {
-		// Redirect all remaining inbound traffic to the proxy.
-		commands = append(
-			commands,
-			fc.makeJumpFromChainToAnotherForAllProtocols(
-				IptablesPreroutingChainName,
-				redirectChainName,
-				"install-proxy-init-prerouting",
-				false))
-	}
-
-	return commands
+	return nil
 }
 
-func (fc FirewallConfiguration) addRulesForInboundPortRedirect(chainName string, commands []*exec.Cmd) []*exec.Cmd {
-	if fc.Mode == RedirectAllMode {
-		// Create a new chain for redirecting inbound and outbound traffic to the proxy port.
-		commands = append(commands, fc.makeRedirectChainToPort(
-			chainName,
-			fc.ProxyInboundPort,
-			"redirect-all-incoming-to-proxy-port"))
-
-	} else if fc.Mode == RedirectListedMode {
-		for _, port := range fc.PortsToRedirectInbound {
-			commands = append(
-				commands,
-				fc.makeRedirectChainToPortBasedOnDestinationPort(
-					chainName,
-					port,
-					fc.ProxyInboundPort,
-					fmt.Sprintf("redirect-port-%d-to-proxy-port", port)))
-		}
+func (fc FirewallConfiguration) backend() Backend {
+	if fc.Backend != nil {
+		return fc.Backend
 	}
-	return commands
-}
 
-func (fc FirewallConfiguration) addRulesForIgnoredPorts(portsToIgnore []string, chainName string, commands []*exec.Cmd) []*exec.Cmd {
-	for _, destinations := range makeMultiportDestinations(portsToIgnore) {
-		commands = append(commands, fc.makeIgnorePorts(chainName, destinations, fmt.Sprintf("ignore-port-%s", strings.Join(destinations, ","))))
+	if fc.NFTables {
+		return NewNFTablesBackend(fc)
 	}
-	return commands
-}
 
-func (fc FirewallConfiguration) addRulesForIgnoredSubnets(chainName string, commands []*exec.Cmd) []*exec.Cmd {
-	for _, subnet := range fc.SubnetsToIgnore {
-		commands = append(commands, fc.makeIgnoreSubnet(chainName, subnet, fmt.Sprintf("ignore-subnet-%s", subnet)))
-	}
-	return commands
+	return NewRestoreBackend(fc)
 }
 
+// makeMultiportDestinations splits the ports to ignore into lists fitting
+// the multiport match. The ports are merged into a PortSet first, so that
+// overlapping ranges are folded and the exclusions applied.
 func makeMultiportDestinations(portsToIgnore []string) [][]string {
 	destinationSlices := make([][]string, 0)
 	destinationPortCount := 0
@@ -282,29 +172,40 @@ func makeMultiportDestinations(portsToIgnore []string) [][]string {
 		return destinationSlices
 	}
 	destinations := make([]string, 0)
-	for _, portOrRange := range portsToIgnore {
-		if portRange, err := util.ParsePortRange(portOrRange); err == nil {
-			// The number of ports referenced for the range
-			portCount := 2
-			if portRange.LowerBound == portRange.UpperBound {
-				// We'll condense for single port ranges
-				portCount = 1
-			}
-			// Check port capacity for the current command
-			if destinationPortCount+portCount > IptablesMultiportLimit {
-				destinationSlices = append(destinationSlices, destinations)
-				destinationPortCount = 0
-				destinations = make([]string, 0)
-			}
-			destinations = append(destinations, asDestination(portRange))
-			destinationPortCount += portCount
-		} else {
-			log.Errorf("invalid port configuration of \"%s\": %s", portOrRange, err.Error())
+	for _, portRange := range makePortSet(portsToIgnore).Ranges() {
+		// The number of ports referenced for the range
+		portCount := 2
+		if portRange.LowerBound == portRange.UpperBound {
+			// We'll condense for single port ranges
+			portCount = 1
 		}
+		// Check port capacity for the current command
+		if destinationPortCount+portCount > IptablesMultiportLimit {
+			destinationSlices = append(destinationSlices, destinations)
+			destinationPortCount = 0
+			destinations = make([]string, 0)
+		}
+		destinations = append(destinations, asDestination(portRange))
+		destinationPortCount += portCount
 	}
 	return append(destinationSlices, destinations)
 }
 
+// makePortSet parses the ports and port ranges into a set, skipping the
+// invalid entries.
+func makePortSet(ports []string) util.PortSet {
+	valid := make([]string, 0, len(ports))
+	for _, portOrRange := range ports {
+		if _, err := util.ParsePortSet(portOrRange); err != nil {
+			log.Errorf("invalid port configuration of \"%s\": %s", portOrRange, err.Error())
+			continue
+		}
+		valid = append(valid, portOrRange)
+	}
+	portSet, _ := util.ParsePortSet(valid...)
+	return portSet
+}
+
 func executeCommand(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd) ([]byte, error) {
 	if firewallConfiguration.NetNs != "" {
 		// BusyBox's `nsenter` needs `--` to separate nsenter arguments from the
@@ -313,7 +214,9 @@ func executeCommand(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd)
 		// See https://github.com/rancher/k3s/issues/1434#issuecomment-629315909
 		nsArgs := fmt.Sprintf("--net=%s", firewallConfiguration.NetNs)
 		args := append([]string{nsArgs, "--"}, cmd.Args...)
+		stdin := cmd.Stdin
 		cmd = exec.Command("nsenter", args...)
+		cmd.Stdin = stdin
 	}
 	log.Info(cmd.String())
 
@@ -330,118 +233,48 @@ func executeCommand(firewallConfiguration FirewallConfiguration, cmd *exec.Cmd)
 	return out, err
 }
 
-func (fc FirewallConfiguration) makeIgnoreUserID(chainName string, uid int, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-m", "owner",
-		"--uid-owner", strconv.Itoa(uid),
-		"-j", "RETURN",
-		"-m", "comment",
-		"--comment", formatComment(comment))
-}
-
-func (fc FirewallConfiguration) makeIgnoreGroupID(chainName string, gid int, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-m", "owner",
-		"--gid-owner", strconv.Itoa(gid),
-		"-j", "RETURN",
-		"-m", "comment",
-		"--comment", formatComment(comment))
-}
-
-func (fc FirewallConfiguration) makeFlushChain(name string) *exec.Cmd {
+func (fc FirewallConfiguration) makeFlushChain(table string, name string) *exec.Cmd {
 	return exec.Command(fc.BinPath,
-		"-t", "nat",
+		"-t", table,
 		"-F", name)
 }
 
-func (fc FirewallConfiguration) makeDeleteChain(name string) *exec.Cmd {
+func (fc FirewallConfiguration) makeDeleteChain(table string, name string) *exec.Cmd {
 	return exec.Command(fc.BinPath,
-		"-t", "nat",
+		"-t", table,
 		"-X", name)
 }
 
-func (fc FirewallConfiguration) makeCreateNewChain(name string) *exec.Cmd {
+func (fc FirewallConfiguration) makeCreateNewChain(table string, name string) *exec.Cmd {
 	return exec.Command(fc.BinPath,
-		"-t", "nat",
+		"-t", table,
 		"-N", name)
 }
 
-func (fc FirewallConfiguration) makeRedirectChainToPort(chainName string, portToRedirect int, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-p", "tcp",
-		"-j", "REDIRECT",
-		"--to-port", strconv.Itoa(portToRedirect),
-		"-m", "comment",
-		"--comment", formatComment(comment))
+func (fc FirewallConfiguration) makeRule(table string, action string, rule Rule) *exec.Cmd {
+	return exec.Command(fc.BinPath, append([]string{"-t", table}, rule.Args(action)...)...)
 }
 
-func (fc FirewallConfiguration) makeIgnorePorts(chainName string, destinations []string, comment string) *exec.Cmd {
+func (fc FirewallConfiguration) makeDeleteRuleNum(table string, chain string, num int) *exec.Cmd {
 	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-p", "tcp",
-		"--match", "multiport",
-		"--dports", strings.Join(destinations, ","),
-		"-j", "RETURN",
-		"-m", "comment",
-		"--comment", formatComment(comment))
+		"-t", table,
+		"-D", chain, strconv.Itoa(num))
 }
 
-func (fc FirewallConfiguration) makeIgnoreSubnet(chainName string, subnet string, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-p", "all",
-		"-j", "RETURN",
-		"-s", subnet,
-		"-m", "comment",
-		"--comment", formatComment(comment))
+func (fc FirewallConfiguration) makeShowAllRules(table string) *exec.Cmd {
+	return exec.Command(fc.SaveBinPath, "-t", table)
 }
 
-func (fc FirewallConfiguration) makeIgnoreLoopback(chainName string, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-o", "lo",
-		"-j", "RETURN",
-		"-m", "comment",
-		"--comment", formatComment(comment))
+func (fc FirewallConfiguration) makeRestore(payload string) *exec.Cmd {
+	cmd := exec.Command(fc.RestoreBinPath, "--noflush")
+	cmd.Stdin = strings.NewReader(payload)
+	return cmd
 }
 
-func (fc FirewallConfiguration) makeRedirectChainToPortBasedOnDestinationPort(chainName string, destinationPort int, portToRedirect int, comment string) *exec.Cmd {
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		"-A", chainName,
-		"-p", "tcp",
-		"--destination-port", strconv.Itoa(destinationPort),
-		"-j", "REDIRECT",
-		"--to-port", strconv.Itoa(portToRedirect),
-		"-m", "comment",
-		"--comment", formatComment(comment))
-}
-
-func (fc FirewallConfiguration) makeJumpFromChainToAnotherForAllProtocols(chainName string, targetChain string, comment string, deleteChain bool) *exec.Cmd {
-	action := "-A"
-	if deleteChain {
-		action = "-D"
-	}
-
-	return exec.Command(fc.BinPath,
-		"-t", "nat",
-		action, chainName,
-		"-j", targetChain,
-		"-m", "comment",
-		"--comment", formatComment(comment))
-}
-
-func (fc FirewallConfiguration) makeShowAllRules() *exec.Cmd {
-	return exec.Command(fc.SaveBinPath, "-t", "nat")
+// restoreBinFor returns the iptables-restore binary belonging to the same
+// family and variant as the provided iptables-save binary.
+func restoreBinFor(saveBinPath string) string {
+	return strings.TrimSuffix(saveBinPath, "-save") + "-restore"
 }
 
 // asDestination formats the provided `PortRange` for output in commands.
@@ -454,7 +287,8 @@ func asDestination(portRange util.PortRange) string {
 }
 
 // resolveBinFallback ensures the configured BinPath and SaveBinPath exist on PATH; if not, it
-// tries reasonable alternatives of the same family (ip6tables vs iptables).
+// tries reasonable alternatives of the same family (ip6tables vs iptables). RestoreBinPath is then
+// resolved as the sibling of the selected SaveBinPath.
 func resolveBinFallback(fc *FirewallConfiguration, lookPath func(string) (string, error)) {
 	// helper to check presence
 	has := func(name string) bool {
@@ -462,6 +296,16 @@ func resolveBinFallback(fc *FirewallConfiguration, lookPath func(string) (string
 		return err == nil
 	}
 
+	resolveBinPairFallback(fc, has)
+
+	fc.RestoreBinPath = restoreBinFor(fc.SaveBinPath)
+	if !has(fc.RestoreBinPath) {
+		log.WithFields(log.Fields{"saveBinPath": fc.SaveBinPath, "restoreBinPath": fc.RestoreBinPath}).Error("iptables: restore binary not found on PATH; applying rules may fail")
+	}
+}
+
+func resolveBinPairFallback(fc *FirewallConfiguration, has func(string) bool) {
+
 	// Both present? nothing to do
 	if has(fc.BinPath) && has(fc.SaveBinPath) {
 		log.WithFields(log.Fields{
@@ -1,8 +1,11 @@
 package iptables
 
 import (
+	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -13,15 +16,18 @@ func TestMakeMultiportDestinations(t *testing.T) {
 	assertEqual(t, makeMultiportDestinations([]string{"22-22", "25-27", "33"}), [][]string{{"22", "25:27", "33"}})
 	assertEqual(t, makeMultiportDestinations([]string{"22", "25-27", "not-a-number", "33"}), [][]string{{"22", "25:27", "33"}})
 	assertEqual(t, makeMultiportDestinations([]string{"22", "25-27", "notanumber", "33"}), [][]string{{"22", "25:27", "33"}})
+	assertEqual(t, makeMultiportDestinations([]string{"33", "25-27", "26-30", "22"}), [][]string{{"22", "25:30", "33"}})
+	assertEqual(t, makeMultiportDestinations([]string{"1-65535", "!4143", "!4191"}), [][]string{{"1:4142", "4144:4190", "4192:65535"}})
+	assertEqual(t, makeMultiportDestinations([]string{">=30000,!30080"}), [][]string{{"30000:30079", "30081:65535"}})
 }
 
 func TestMakeMultiportDestinations_Split(t *testing.T) {
 	assertEqual(t,
 		makeMultiportDestinations([]string{"22-23", "25-27", "33-34", "35-35", "37-38", "50-54", "56-57", "60-63"}),
-		[][]string{{"22:23", "25:27", "33:34", "35", "37:38", "50:54", "56:57", "60:63"}})
+		[][]string{{"22:23", "25:27", "33:35", "37:38", "50:54", "56:57", "60:63"}})
 	assertEqual(t,
 		makeMultiportDestinations([]string{"22-23", "25-27", "33-34", "35-35", "37-38", "50-54", "56", "58", "60", "63", "70-72"}),
-		[][]string{{"22:23", "25:27", "33:34", "35", "37:38", "50:54", "56", "58", "60", "63"}, {"70:72"}})
+		[][]string{{"22:23", "25:27", "33:35", "37:38", "50:54", "56", "58", "60", "63"}, {"70:72"}})
 }
 
 var existingRules = []byte(`# iptables-save
@@ -52,8 +58,8 @@ func TestAddIncomingTrafficRules(t *testing.T) {
 			name: "no existing rules, create new chain and PREROUTING rule",
 			wantCommands: []*exec.Cmd{
 				exec.Command("<iptables>", "-t", "nat", "-N", "PROXY_INIT_REDIRECT"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_REDIRECT", "-p", "tcp", "--match", "multiport", "--dports", "1234", "-j", "RETURN", "-m", "comment", "--comment", "proxy-init/ignore-port-1234"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PREROUTING", "-j", "PROXY_INIT_REDIRECT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-prerouting"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_REDIRECT", "-p", "tcp", "-m", "multiport", "--dports", "1234", "-m", "comment", "--comment", "proxy-init/ignore-port-1234", "-j", "RETURN"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PREROUTING", "-m", "comment", "--comment", "proxy-init/install-proxy-init-prerouting", "-j", "PROXY_INIT_REDIRECT"),
 			},
 		},
 		{
@@ -61,7 +67,7 @@ func TestAddIncomingTrafficRules(t *testing.T) {
 			existingRules: existingRules,
 			wantCommands: []*exec.Cmd{
 				exec.Command("<iptables>", "-t", "nat", "-F", "PROXY_INIT_REDIRECT"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_REDIRECT", "-p", "tcp", "--match", "multiport", "--dports", "1234", "-j", "RETURN", "-m", "comment", "--comment", "proxy-init/ignore-port-1234"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_REDIRECT", "-p", "tcp", "-m", "multiport", "--dports", "1234", "-m", "comment", "--comment", "proxy-init/ignore-port-1234", "-j", "RETURN"),
 			},
 		},
 	} {
@@ -70,7 +76,9 @@ func TestAddIncomingTrafficRules(t *testing.T) {
 				BinPath:              "<iptables>",
 				InboundPortsToIgnore: []string{"1234"},
 			}
-			cmds := fc.addIncomingTrafficRules(tt.existingRules, nil)
+			rs := &Ruleset{}
+			fc.addIncomingTrafficRules(rs)
+			cmds := (&execBackend{fc: *fc}).configureCommands(rs, map[string][]byte{TableNAT: tt.existingRules})
 			assertEqual(t, cmds, tt.wantCommands)
 		})
 	}
@@ -86,9 +94,9 @@ func TestAddOutgoingTrafficRules(t *testing.T) {
 			name: "no existing rules, create new chain and OUTPUT rule",
 			wantCommands: []*exec.Cmd{
 				exec.Command("<iptables>", "-t", "nat", "-N", "PROXY_INIT_OUTPUT"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-o", "lo", "-j", "RETURN", "-m", "comment", "--comment", "proxy-init/ignore-loopback"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-p", "tcp", "-j", "REDIRECT", "--to-port", "1234", "-m", "comment", "--comment", "proxy-init/redirect-all-outgoing-to-proxy-port"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "OUTPUT", "-j", "PROXY_INIT_OUTPUT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-output"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-o", "lo", "-m", "comment", "--comment", "proxy-init/ignore-loopback", "-j", "RETURN"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-p", "tcp", "-m", "comment", "--comment", "proxy-init/redirect-all-outgoing-to-proxy-port", "-j", "REDIRECT", "--to-ports", "1234"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "OUTPUT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-output", "-j", "PROXY_INIT_OUTPUT"),
 			},
 		},
 		{
@@ -96,8 +104,8 @@ func TestAddOutgoingTrafficRules(t *testing.T) {
 			existingRules: existingRules,
 			wantCommands: []*exec.Cmd{
 				exec.Command("<iptables>", "-t", "nat", "-F", "PROXY_INIT_OUTPUT"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-o", "lo", "-j", "RETURN", "-m", "comment", "--comment", "proxy-init/ignore-loopback"),
-				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-p", "tcp", "-j", "REDIRECT", "--to-port", "1234", "-m", "comment", "--comment", "proxy-init/redirect-all-outgoing-to-proxy-port"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-o", "lo", "-m", "comment", "--comment", "proxy-init/ignore-loopback", "-j", "RETURN"),
+				exec.Command("<iptables>", "-t", "nat", "-A", "PROXY_INIT_OUTPUT", "-p", "tcp", "-m", "comment", "--comment", "proxy-init/redirect-all-outgoing-to-proxy-port", "-j", "REDIRECT", "--to-ports", "1234"),
 			},
 		},
 	} {
@@ -106,17 +114,84 @@ func TestAddOutgoingTrafficRules(t *testing.T) {
 				BinPath:           "<iptables>",
 				ProxyOutgoingPort: 1234,
 			}
-			cmds := fc.addOutgoingTrafficRules(tt.existingRules, nil)
+			rs := &Ruleset{}
+			fc.addOutgoingTrafficRules(rs)
+			cmds := (&execBackend{fc: *fc}).configureCommands(rs, map[string][]byte{TableNAT: tt.existingRules})
 			assertEqual(t, cmds, tt.wantCommands)
 		})
 	}
 
 }
 
+func TestAddOutgoingTrafficRules_DNS(t *testing.T) {
+	fc := FirewallConfiguration{
+		ProxyOutgoingPort:     4140,
+		ProxyOutboundDNSPort:  4153,
+		ProxyUID:              2102,
+		OutboundPortsToIgnore: []string{"443"},
+	}
+	rs := &Ruleset{}
+	fc.addOutgoingTrafficRules(rs)
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -m comment --comment "proxy-init/ignore-proxy-user-id" -j RETURN
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m multiport --dports 443 -m comment --comment "proxy-init/ignore-port-443" -j RETURN
+-A PROXY_INIT_OUTPUT -p udp -m udp --dport 53 -m comment --comment "proxy-init/redirect-dns-udp-to-proxy-port" -j REDIRECT --to-ports 4153
+-A PROXY_INIT_OUTPUT -p tcp -m tcp --dport 53 -m comment --comment "proxy-init/redirect-dns-tcp-to-proxy-port" -j REDIRECT --to-ports 4153
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
+
+func TestAddIncomingTrafficRules_TProxy(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                    RedirectListedMode,
+		PortsToRedirectInbound:  []int{8080},
+		InboundPortsToIgnore:    []string{"4190"},
+		SubnetsToIgnore:         []string{"fd00::/8"},
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		InboundInterceptionMode: InboundInterceptionModeTProxy,
+		IPv6:                    true,
+	}
+	rs := fc.Ruleset()
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*mangle
+:PROXY_INIT_TPROXY - [0:0]
+-A PROXY_INIT_TPROXY -i lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_TPROXY -p tcp -m multiport --dports 4190 -m comment --comment "proxy-init/ignore-port-4190" -j RETURN
+-A PROXY_INIT_TPROXY -s fd00::/8 -m comment --comment "proxy-init/ignore-subnet-fd00::/8" -j RETURN
+-A PROXY_INIT_TPROXY -p tcp -m tcp --dport 8080 -m comment --comment "proxy-init/tproxy-port-8080-to-proxy-port" -j TPROXY --on-port 4143 --on-ip :: --tproxy-mark 0x539/0xffffffff
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-tproxy" -j PROXY_INIT_TPROXY
+COMMIT
+*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+	assertEqual(t, rs.Routes, []PolicyRoute{{Mark: DefaultTProxyMark, Table: DefaultTProxyRouteTable, IPv6: true}})
+
+	cmds := []*exec.Cmd{}
+	for _, route := range rs.Routes {
+		cmds = append(cmds,
+			fc.makeIP(route, append([]string{"rule", "add"}, fc.makeRuleArgs(route)...)...),
+			fc.makeIP(route, append([]string{"route", "replace"}, fc.makeRouteArgs(route)...)...))
+	}
+	assertEqual(t, cmds, []*exec.Cmd{
+		exec.Command("ip", "-6", "rule", "add", "fwmark", "0x539", "lookup", "133"),
+		exec.Command("ip", "-6", "route", "replace", "local", "default", "dev", "lo", "table", "133"),
+	})
+}
+
 func TestCleanupFirewallConfig(t *testing.T) {
 	wantCommands := []*exec.Cmd{
-		exec.Command("<iptables>", "-t", "nat", "-D", "PREROUTING", "-j", "PROXY_INIT_REDIRECT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-prerouting"),
-		exec.Command("<iptables>", "-t", "nat", "-D", "OUTPUT", "-j", "PROXY_INIT_OUTPUT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-output"),
+		exec.Command("<iptables>", "-t", "nat", "-D", "PREROUTING", "-m", "comment", "--comment", "proxy-init/install-proxy-init-prerouting", "-j", "PROXY_INIT_REDIRECT"),
+		exec.Command("<iptables>", "-t", "nat", "-D", "OUTPUT", "-m", "comment", "--comment", "proxy-init/install-proxy-init-output", "-j", "PROXY_INIT_OUTPUT"),
 		exec.Command("<iptables>", "-t", "nat", "-F", "PROXY_INIT_OUTPUT"),
 		exec.Command("<iptables>", "-t", "nat", "-F", "PROXY_INIT_REDIRECT"),
 		exec.Command("<iptables>", "-t", "nat", "-X", "PROXY_INIT_OUTPUT"),
@@ -127,13 +202,386 @@ func TestCleanupFirewallConfig(t *testing.T) {
 		BinPath:              "<iptables>",
 		InboundPortsToIgnore: []string{"1234"},
 	}
-	cmds := fc.cleanupRules(nil)
+	cmds, _ := (&execBackend{fc: *fc}).cleanupCommands(fc.Ruleset(), nil)
 	assertEqual(t, cmds, wantCommands)
 
 }
 
+func TestCleanupFirewallConfig_PartialState(t *testing.T) {
+	// the PREROUTING jump is duplicated, and PROXY_INIT_OUTPUT is already gone
+	existing := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A PREROUTING -m comment --comment "some-other-tool" -j RETURN
+-A PREROUTING -j PROXY_INIT_REDIRECT
+-A OUTPUT -m comment --comment "some-other-tool" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 1234 -m comment --comment "proxy-init/ignore-port-1234" -j RETURN
+COMMIT
+`)
+	wantCommands := []*exec.Cmd{
+		exec.Command("<iptables>", "-t", "nat", "-D", "PREROUTING", "3"),
+		exec.Command("<iptables>", "-t", "nat", "-D", "PREROUTING", "1"),
+		exec.Command("<iptables>", "-t", "nat", "-F", "PROXY_INIT_REDIRECT"),
+		exec.Command("<iptables>", "-t", "nat", "-X", "PROXY_INIT_REDIRECT"),
+	}
+
+	fc := &FirewallConfiguration{
+		BinPath:              "<iptables>",
+		InboundPortsToIgnore: []string{"1234"},
+	}
+	cmds, removed := (&execBackend{fc: *fc}).cleanupCommands(fc.Ruleset(), map[string][]byte{TableNAT: existing})
+	assertEqual(t, cmds, wantCommands)
+	assertEqual(t, removed, []string{
+		"jump from PREROUTING to PROXY_INIT_REDIRECT in table nat",
+		"jump from PREROUTING to PROXY_INIT_REDIRECT in table nat",
+		"chain PROXY_INIT_REDIRECT from table nat",
+	})
+}
+
+func TestMakeRestorePayload(t *testing.T) {
+	fc := &FirewallConfiguration{
+		Mode:                 RedirectAllMode,
+		InboundPortsToIgnore: []string{"1234"},
+		SubnetsToIgnore:      []string{"10.0.0.1/8"},
+		ProxyInboundPort:     4143,
+		ProxyOutgoingPort:    4140,
+	}
+
+	// only the PREROUTING jump already exists
+	payload := makeRestorePayload(fc.Ruleset(), map[string][]byte{
+		TableNAT: []byte(`-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT`),
+	})
+
+	assertEqual(t, payload, `*nat
+:PROXY_INIT_REDIRECT - [0:0]
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 1234 -m comment --comment "proxy-init/ignore-port-1234" -j RETURN
+-A PROXY_INIT_REDIRECT -s 10.0.0.0/8 -m comment --comment "proxy-init/ignore-subnet-10.0.0.1/8" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
+
+func TestRuleString(t *testing.T) {
+	rule := Rule{Chain: outputChainName, OutInterface: "lo", Comment: "ignore \"lo\"", Target: TargetReturn}
+	assertEqual(t, rule.String(), `-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore \"lo\"" -j RETURN`)
+
+	rule = Rule{Chain: redirectChainName, Protocol: "tcp", DestinationPort: 8080, Comment: "redirect-port-8080-to-proxy-port", Target: TargetRedirect, ToPort: 4143}
+	assertEqual(t, rule.String(), `-A PROXY_INIT_REDIRECT -p tcp -m tcp --dport 8080 -m comment --comment "proxy-init/redirect-port-8080-to-proxy-port" -j REDIRECT --to-ports 4143`)
+}
+
+func TestConfigureFirewall_Backend(t *testing.T) {
+	backend := NewFakeBackend()
+	fc := FirewallConfiguration{
+		Mode:                   RedirectListedMode,
+		PortsToRedirectInbound: []int{8080},
+		ProxyInboundPort:       4143,
+		ProxyOutgoingPort:      4140,
+		ProxyUID:               2102,
+		Backend:                backend,
+	}
+
+	// configuring twice must not duplicate the jumps
+	for i := 0; i < 2; i++ {
+		if err := ConfigureFirewall(fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	assertEqual(t, backend.Tables, map[string]map[string][]Rule{
+		TableNAT: {
+			IptablesPreroutingChainName: {
+				{Chain: IptablesPreroutingChainName, Comment: "install-proxy-init-prerouting", Target: redirectChainName},
+			},
+			IptablesOutputChainName: {
+				{Chain: IptablesOutputChainName, Comment: "install-proxy-init-output", Target: outputChainName},
+			},
+			redirectChainName: {
+				{Chain: redirectChainName, Protocol: "tcp", DestinationPort: 8080, Comment: "redirect-port-8080-to-proxy-port", Target: TargetRedirect, ToPort: 4143},
+			},
+			outputChainName: {
+				{Chain: outputChainName, UIDOwner: 2102, Comment: "ignore-proxy-user-id", Target: TargetReturn},
+				{Chain: outputChainName, OutInterface: "lo", Comment: "ignore-loopback", Target: TargetReturn},
+				{Chain: outputChainName, Protocol: "tcp", Comment: "redirect-all-outgoing-to-proxy-port", Target: TargetRedirect, ToPort: 4140},
+			},
+		},
+	})
+
+	if err := CleanupFirewallConfig(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertEqual(t, backend.Tables, map[string]map[string][]Rule{TableNAT: {}})
+}
+
+func TestConfigureFirewall_BackendTProxy(t *testing.T) {
+	backend := NewFakeBackend()
+	fc := FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		InboundInterceptionMode: InboundInterceptionModeTProxy,
+		TProxyMark:              0x10,
+		TProxyRouteTable:        200,
+		NFTables:                true,
+		IPv6:                    true,
+		Backend:                 backend,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ConfigureFirewall(fc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	assertEqual(t, backend.Routes, []PolicyRoute{{Mark: 0x10, Table: 200}, {Mark: 0x10, Table: 200, IPv6: true}})
+	assertEqual(t, len(backend.Tables[TableMangle][tproxyChainName]), 2)
+
+	if err := CleanupFirewallConfig(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertEqual(t, backend.Routes, []PolicyRoute{})
+	assertEqual(t, backend.Tables, map[string]map[string][]Rule{TableNAT: {}, TableMangle: {}})
+}
+
 func assertEqual(t *testing.T, check, expected interface{}) {
 	if !reflect.DeepEqual(check, expected) {
 		t.Fatalf("mismatch: got \"%s\" expected \"%s\"", check, expected)
 	}
 }
+
+func TestAddOutgoingTrafficRules_Cgroup(t *testing.T) {
+	fc := FirewallConfiguration{
+		ProxyOutgoingPort: 4140,
+		ProxyCgroupPath:   "/kubepods/pod1234/proxy",
+	}
+	rs := &Ruleset{}
+	fc.addOutgoingTrafficRules(rs)
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -m cgroup --path "/kubepods/pod1234/proxy" -m comment --comment "proxy-init/ignore-proxy-cgroup" -j RETURN
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
+
+func TestAddOutgoingTrafficRules_Mark(t *testing.T) {
+	fc := FirewallConfiguration{
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+		ProxyMark:         0x2a,
+	}
+	rs := &Ruleset{}
+	fc.addOutgoingTrafficRules(rs)
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -m comment --comment "proxy-init/ignore-proxy-user-id" -j RETURN
+-A PROXY_INIT_OUTPUT -m mark --mark 0x2a -m comment --comment "proxy-init/ignore-proxy-mark" -j RETURN
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
+
+func TestAddOutgoingTrafficRules_Subnets(t *testing.T) {
+	fc := FirewallConfiguration{
+		ProxyOutgoingPort:       4140,
+		OutboundPortsToIgnore:   []string{"443"},
+		OutboundSubnetsToIgnore: []string{"169.254.169.254/32", "10.10.0.1/16"},
+	}
+	rs := &Ruleset{}
+	fc.addOutgoingTrafficRules(rs)
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m multiport --dports 443 -m comment --comment "proxy-init/ignore-port-443" -j RETURN
+-A PROXY_INIT_OUTPUT -d 169.254.169.254/32 -m comment --comment "proxy-init/ignore-outbound-subnet-169.254.169.254/32" -j RETURN
+-A PROXY_INIT_OUTPUT -d 10.10.0.0/16 -m comment --comment "proxy-init/ignore-outbound-subnet-10.10.0.1/16" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
+
+func TestRuleset_UseSets(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		InboundPortsToIgnore:    []string{"4190-4191", "25", "notanumber"},
+		SubnetsToIgnore:         []string{"10.0.0.1/8", "192.168.0.0/16"},
+		OutboundSubnetsToIgnore: []string{"169.254.169.254/32"},
+		UseSets:                 true,
+	}
+	rs := fc.Ruleset()
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_REDIRECT - [0:0]
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_REDIRECT -p tcp -m set --match-set PROXY_INIT_IN_PORTS dst -m comment --comment "proxy-init/ignore-port-set-PROXY_INIT_IN_PORTS" -j RETURN
+-A PROXY_INIT_REDIRECT -m set --match-set PROXY_INIT_IN_SUBNETS src -m comment --comment "proxy-init/ignore-subnet-set-PROXY_INIT_IN_SUBNETS" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -m set --match-set PROXY_INIT_OUT_SUBNETS dst -m comment --comment "proxy-init/ignore-subnet-set-PROXY_INIT_OUT_SUBNETS" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+
+	assertEqual(t, makeIPSetPayload(rs.Sets), `create PROXY_INIT_IN_PORTS bitmap:port range 0-65535
+flush PROXY_INIT_IN_PORTS
+add PROXY_INIT_IN_PORTS 25
+add PROXY_INIT_IN_PORTS 4190-4191
+create PROXY_INIT_IN_SUBNETS hash:net family inet
+flush PROXY_INIT_IN_SUBNETS
+add PROXY_INIT_IN_SUBNETS 10.0.0.0/8
+add PROXY_INIT_IN_SUBNETS 192.168.0.0/16
+create PROXY_INIT_OUT_SUBNETS hash:net family inet
+flush PROXY_INIT_OUT_SUBNETS
+add PROXY_INIT_OUT_SUBNETS 169.254.169.254/32
+`)
+
+	fc.IPv6 = true
+	fc.SubnetsToIgnore = []string{"fd00::/8"}
+	fc.OutboundSubnetsToIgnore = nil
+	assertEqual(t, makeIPSetPayload(fc.Ruleset().Sets), `create PROXY_INIT_IN_PORTS6 bitmap:port range 0-65535
+flush PROXY_INIT_IN_PORTS6
+add PROXY_INIT_IN_PORTS6 25
+add PROXY_INIT_IN_PORTS6 4190-4191
+create PROXY_INIT_IN_SUBNETS6 hash:net family inet6
+flush PROXY_INIT_IN_SUBNETS6
+add PROXY_INIT_IN_SUBNETS6 fd00::/8
+`)
+}
+
+func TestMakeIPSetPayload_WholeAddressSpace(t *testing.T) {
+	sets := []Set{
+		{Name: "PROXY_INIT_OUT_SUBNETS", Type: SetTypeNet, Elements: []string{"0.0.0.0/0"}},
+		{Name: "PROXY_INIT_OUT_SUBNETS6", Type: SetTypeNet, IPv6: true, Elements: []string{"::/0", "fd00::/8"}},
+	}
+
+	assertEqual(t, makeIPSetPayload(sets), `create PROXY_INIT_OUT_SUBNETS hash:net family inet
+flush PROXY_INIT_OUT_SUBNETS
+add PROXY_INIT_OUT_SUBNETS 0.0.0.0/1
+add PROXY_INIT_OUT_SUBNETS 128.0.0.0/1
+create PROXY_INIT_OUT_SUBNETS6 hash:net family inet6
+flush PROXY_INIT_OUT_SUBNETS6
+add PROXY_INIT_OUT_SUBNETS6 ::/1
+add PROXY_INIT_OUT_SUBNETS6 8000::/1
+add PROXY_INIT_OUT_SUBNETS6 fd00::/8
+`)
+}
+
+func TestConfigureFirewall_BackendSets(t *testing.T) {
+	backend := NewFakeBackend()
+	fc := FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		OutboundPortsToIgnore: []string{"443"},
+		UseSets:               true,
+		Backend:               backend,
+	}
+
+	if err := ConfigureFirewall(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := backend.Sets["PROXY_INIT_OUT_PORTS"]; !ok || len(backend.Sets) != 1 {
+		t.Fatalf("expected the PROXY_INIT_OUT_PORTS set, got %v", backend.Sets)
+	}
+
+	if err := CleanupFirewallConfig(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(backend.Sets) != 0 {
+		t.Fatalf("expected no set left, got %v", backend.Sets)
+	}
+}
+
+// TestConfigureFirewall_CgroupPath covers the setups the proxy cgroup suits:
+// a cgroup existing when the rules are installed, such as the one of a proxy
+// running as a node service. The cgroup of a proxy container, created by the
+// runtime afterwards, is reported before any rule is installed.
+func TestConfigureFirewall_CgroupPath(t *testing.T) {
+	root := cgroupRoot
+	defer func() { cgroupRoot = root }()
+	cgroupRoot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cgroupRoot, "system.slice", "linkerd-proxy.service"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		path     string
+		simulate bool
+		err      string
+	}{
+		{name: "existing cgroup", path: "system.slice/linkerd-proxy.service"},
+		{name: "container cgroup not created yet", path: "kubepods.slice/pod1234/cri-containerd-abcd.scope", err: "the proxy cgroup kubepods.slice/pod1234/cri-containerd-abcd.scope must exist when the rules are installed"},
+		{name: "simulation", path: "kubepods.slice/pod1234/cri-containerd-abcd.scope", simulate: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewFakeBackend()
+			fc := FirewallConfiguration{
+				Mode:              RedirectAllMode,
+				ProxyInboundPort:  4143,
+				ProxyOutgoingPort: 4140,
+				ProxyCgroupPath:   tt.path,
+				SimulateOnly:      tt.simulate,
+				Backend:           backend,
+			}
+
+			err := ConfigureFirewall(fc)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if len(backend.Tables["nat"][outputChainName]) == 0 {
+					t.Fatal("expected the rules to be installed")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+			if len(backend.Tables) != 0 {
+				t.Fatalf("expected no rule to be installed, got %v", backend.Tables)
+			}
+		})
+	}
+}
+
+func TestAddIncomingTrafficRules_PortsFromSubnets(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                            RedirectAllMode,
+		ProxyInboundPort:                4143,
+		InboundPortsToIgnore:            []string{"4190"},
+		InboundPortsToIgnoreFromSubnets: []string{"4191@10.1.2.3/8", "9990-9999@192.168.0.0/16", "invalid"},
+	}
+	rs := &Ruleset{}
+	fc.addIncomingTrafficRules(rs)
+
+	assertEqual(t, makeRestorePayload(rs, nil), `*nat
+:PROXY_INIT_REDIRECT - [0:0]
+-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 4190 -m comment --comment "proxy-init/ignore-port-4190" -j RETURN
+-A PROXY_INIT_REDIRECT -s 10.0.0.0/8 -p tcp -m multiport --dports 4191 -m comment --comment "proxy-init/ignore-port-4191-from-10.0.0.0/8" -j RETURN
+-A PROXY_INIT_REDIRECT -s 192.168.0.0/16 -p tcp -m multiport --dports 9990:9999 -m comment --comment "proxy-init/ignore-port-9990:9999-from-192.168.0.0/16" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+COMMIT
+`)
+}
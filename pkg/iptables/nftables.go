@@ -0,0 +1,784 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	util "github.com/linkerd/linkerd2-proxy-init/pkg/util"
+)
+
+const (
+	// NFTablesTableName is the name of the inet table holding all the rules
+	// installed by the nftables backend.
+	NFTablesTableName = "proxy_init"
+
+	// ifNameSize is the size of an interface name as compared by the kernel
+	// (IFNAMSIZ), including the trailing NUL byte.
+	ifNameSize = 16
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted, used to resolve
+// cgroup paths into the IDs nftables matches on.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// nftRule is a single rule to be appended to a chain of the proxy-init inet
+// table. The text field holds the nft syntax of the expressions, and is only
+// used for logging.
+type nftRule struct {
+	chain   string
+	exprs   []expr.Any
+	text    []string
+	comment string
+}
+
+func newNFTRule(chain string, comment string) *nftRule {
+	return &nftRule{chain: chain, comment: comment}
+}
+
+// match appends the expressions to the rule, along with their nft syntax.
+func (r *nftRule) match(text string, exprs ...expr.Any) *nftRule {
+	r.exprs = append(r.exprs, exprs...)
+	r.text = append(r.text, text)
+	return r
+}
+
+// String renders the rule using the nft command line syntax.
+func (r *nftRule) String() string {
+	return fmt.Sprintf("add rule inet %s %s %s comment \"%s\"",
+		NFTablesTableName, r.chain, strings.Join(r.text, " "), formatComment(r.comment))
+}
+
+// NewNFTablesBackend returns a Backend installing the rules in a dedicated
+// inet table, speaking to the kernel over netlink. Since the table handles
+// both IPv4 and IPv6, IPv6 traffic is only redirected when fc.IPv6 is set.
+func NewNFTablesBackend(fc FirewallConfiguration) Backend {
+	return &nftablesBackend{fc: fc}
+}
+
+type nftablesBackend struct {
+	fc FirewallConfiguration
+}
+
+// Configure implements Backend. Any previous version of the table is replaced
+// in the same transaction, so the operation is atomic and idempotent.
+func (b *nftablesBackend) Configure(ruleset *Ruleset) error {
+	log.Debugf("using nftables to configure firewall rules in table inet %s", NFTablesTableName)
+
+	rules, err := makeNFTRules(ruleset, b.fc.IPv6)
+	if err != nil {
+		log.Error("aborting firewall configuration")
+		return err
+	}
+	sets := make([]*nftSet, 0, len(ruleset.Sets))
+	for _, set := range ruleset.Sets {
+		nftSet, err := makeNFTSet(set)
+		if err != nil {
+			log.Error("aborting firewall configuration")
+			return err
+		}
+		log.Info(nftSet.String())
+		sets = append(sets, nftSet)
+	}
+	for _, rule := range rules {
+		log.Info(rule.String())
+	}
+
+	if b.fc.SimulateOnly {
+		return configureRoutes(b.fc, ruleset.Routes)
+	}
+
+	conn, closeNetNs, err := newNFTConn(b.fc.NetNs)
+	if err != nil {
+		return err
+	}
+	defer closeNetNs()
+
+	// Adding and then deleting the table ensures the delete never fails
+	// because the table is absent; the table is then re-created from scratch.
+	table := &nftables.Table{Name: NFTablesTableName, Family: nftables.TableFamilyINet}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	table = conn.AddTable(table)
+
+	chains := map[string]*nftables.Chain{}
+	for _, chain := range ruleset.Chains {
+		base := nftBaseChains[chain.Table][chain.Jump.Chain]
+		if _, ok := chains[base.Name]; !ok {
+			chains[base.Name] = conn.AddChain(&nftables.Chain{
+				Name:     base.Name,
+				Table:    table,
+				Type:     base.Type,
+				Hooknum:  base.Hooknum,
+				Priority: base.Priority,
+			})
+		}
+		chains[chain.Name] = conn.AddChain(&nftables.Chain{Name: chain.Name, Table: table})
+	}
+
+	setIDs := map[string]uint32{}
+	for _, set := range sets {
+		nftSet := &nftables.Set{Table: table, Name: set.name, KeyType: set.keyType, Interval: true}
+		if err := conn.AddSet(nftSet, set.elements()); err != nil {
+			return fmt.Errorf("failed to add nftables set %s: %w", set.name, err)
+		}
+		setIDs[set.name] = nftSet.ID
+	}
+
+	for _, rule := range rules {
+		// the sets are referenced by their ID within the transaction
+		for _, e := range rule.exprs {
+			if lookup, ok := e.(*expr.Lookup); ok {
+				lookup.SetID = setIDs[lookup.SetName]
+			}
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chains[rule.chain],
+			Exprs:    rule.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, formatComment(rule.comment)),
+		})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to configure nftables table inet %s: %w", NFTablesTableName, err)
+	}
+
+	return configureRoutes(b.fc, ruleset.Routes)
+}
+
+// Cleanup implements Backend, removing the whole inet table along with all of
+// its chains and rules.
+func (b *nftablesBackend) Cleanup(ruleset *Ruleset) error {
+	cleanupRoutes(b.fc, ruleset.Routes)
+
+	log.Infof("delete table inet %s", NFTablesTableName)
+
+	if b.fc.SimulateOnly {
+		return nil
+	}
+
+	conn, closeNetNs, err := newNFTConn(b.fc.NetNs)
+	if err != nil {
+		return err
+	}
+	defer closeNetNs()
+
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+
+	for _, table := range tables {
+		if table.Name == NFTablesTableName {
+			conn.DelTable(table)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("failed to delete nftables table inet %s: %w", NFTablesTableName, err)
+			}
+			log.Infof("removed table inet %s", NFTablesTableName)
+			return nil
+		}
+	}
+
+	log.Infof("table inet %s not found, nothing to clean up", NFTablesTableName)
+	return nil
+}
+
+// Verify implements Backend. Since the kernel doesn't keep the nft syntax of
+// the rules, their expressions are compared instead, along with their
+// comment.
+func (b *nftablesBackend) Verify(ruleset *Ruleset) ([]Drift, error) {
+	rules, err := makeNFTRules(ruleset, b.fc.IPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.fc.SimulateOnly {
+		log.Infof("list table inet %s", NFTablesTableName)
+		return nil, nil
+	}
+
+	conn, closeNetNs, err := newNFTConn(b.fc.NetNs)
+	if err != nil {
+		return nil, err
+	}
+	defer closeNetNs()
+
+	installed, err := b.listRules(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyNFTRules(rules, installed), nil
+}
+
+// verifyNFTRules compares the expected rules against the installed ones,
+// indexed by chain name. A rule is rendered in the drifts with the nft syntax
+// when expected, and with its expressions when only installed.
+func verifyNFTRules(rules []*nftRule, installed map[string][]*nftables.Rule) []Drift {
+	// chains are verified in the order they appear in the ruleset
+	chains := make([]string, 0)
+	expected := map[string][]string{}
+	texts := map[string]string{}
+	for _, rule := range rules {
+		if _, ok := expected[rule.chain]; !ok {
+			chains = append(chains, rule.chain)
+		}
+		key := nftRuleKey(formatComment(rule.comment), rule.exprs)
+		expected[rule.chain] = append(expected[rule.chain], key)
+		texts[key] = rule.String()
+	}
+
+	got := map[string][]string{}
+	for chain, chainRules := range installed {
+		got[chain] = make([]string, 0, len(chainRules))
+		for _, rule := range chainRules {
+			comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment)
+			got[chain] = append(got[chain], nftRuleKey(comment, rule.Exprs))
+		}
+	}
+
+	drifts := make([]Drift, 0)
+	for _, chain := range chains {
+		drifts = append(drifts, diffRules(NFTablesTableName, chain, expected[chain], got[chain])...)
+	}
+	unexpected := make([]string, 0)
+	for chain := range got {
+		if _, ok := expected[chain]; !ok {
+			unexpected = append(unexpected, chain)
+		}
+	}
+	sort.Strings(unexpected)
+	for _, chain := range unexpected {
+		drifts = append(drifts, diffRules(NFTablesTableName, chain, nil, got[chain])...)
+	}
+
+	for i := range drifts {
+		if text, ok := texts[drifts[i].Rule]; ok {
+			drifts[i].Rule = text
+		}
+	}
+
+	return drifts
+}
+
+// listRules returns the rules of the proxy-init inet table, indexed by chain
+// name. The result is empty when the table doesn't exist.
+func (b *nftablesBackend) listRules(conn *nftables.Conn) (map[string][]*nftables.Rule, error) {
+	installed := map[string][]*nftables.Rule{}
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables chains: %w", err)
+	}
+
+	for _, chain := range chains {
+		if chain.Table.Name != NFTablesTableName {
+			continue
+		}
+
+		rules, err := conn.GetRules(chain.Table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules of nftables chain %s: %w", chain.Name, err)
+		}
+		installed[chain.Name] = rules
+	}
+
+	return installed, nil
+}
+
+// nftRuleKey renders the comment and the expressions of a rule, in a form
+// comparable between the rules built by makeNFTRules and the ones decoded
+// from the kernel. Only the fields of the expressions set by makeNFTRules
+// are taken into account.
+func nftRuleKey(comment string, exprs []expr.Any) string {
+	parts := make([]string, 0, len(exprs)+1)
+	for _, e := range exprs {
+		parts = append(parts, nftExprString(e))
+	}
+	parts = append(parts, fmt.Sprintf("comment \"%s\"", comment))
+	return strings.Join(parts, " ")
+}
+
+var nftMetaKeys = map[expr.MetaKey]string{
+	expr.MetaKeyNFPROTO: "nfproto",
+	expr.MetaKeyL4PROTO: "l4proto",
+	expr.MetaKeyIIFNAME: "iifname",
+	expr.MetaKeyOIFNAME: "oifname",
+	expr.MetaKeySKUID:   "skuid",
+	expr.MetaKeySKGID:   "skgid",
+	expr.MetaKeyMARK:    "mark",
+}
+
+func nftCmpOp(op expr.CmpOp) string {
+	if op == expr.CmpOpEq {
+		return "eq"
+	}
+	return fmt.Sprintf("%d", op)
+}
+
+// nftExprString renders the expression like nft --debug=netlink does.
+func nftExprString(e expr.Any) string {
+	switch e := e.(type) {
+	case *expr.Meta:
+		key, ok := nftMetaKeys[e.Key]
+		if !ok {
+			key = fmt.Sprintf("%d", e.Key)
+		}
+		if e.SourceRegister {
+			return fmt.Sprintf("[ meta set %s with reg %d ]", key, e.Register)
+		}
+		return fmt.Sprintf("[ meta load %s => reg %d ]", key, e.Register)
+	case *expr.Cmp:
+		return fmt.Sprintf("[ cmp %s reg %d 0x%x ]", nftCmpOp(e.Op), e.Register, e.Data)
+	case *expr.Range:
+		return fmt.Sprintf("[ range %s reg %d 0x%x 0x%x ]", nftCmpOp(e.Op), e.Register, e.FromData, e.ToData)
+	case *expr.Payload:
+		return fmt.Sprintf("[ payload load %db @ %d header + %d => reg %d ]", e.Len, e.Base, e.Offset, e.DestRegister)
+	case *expr.Bitwise:
+		return fmt.Sprintf("[ bitwise reg %d = ( reg %d & 0x%x ) ^ 0x%x ]", e.DestRegister, e.SourceRegister, e.Mask, e.Xor)
+	case *expr.Lookup:
+		return fmt.Sprintf("[ lookup reg %d set %s ]", e.SourceRegister, e.SetName)
+	case *expr.Immediate:
+		return fmt.Sprintf("[ immediate reg %d 0x%x ]", e.Register, e.Data)
+	case *expr.Verdict:
+		switch e.Kind {
+		case expr.VerdictReturn:
+			return "[ immediate reg 0 return ]"
+		case expr.VerdictJump:
+			return fmt.Sprintf("[ immediate reg 0 jump %s ]", e.Chain)
+		default:
+			return fmt.Sprintf("[ immediate reg 0 %d %s ]", e.Kind, e.Chain)
+		}
+	case *expr.Redir:
+		return fmt.Sprintf("[ redir proto_min reg %d ]", e.RegisterProtoMin)
+	case *expr.TProxy:
+		return fmt.Sprintf("[ tproxy family %d table family %d port reg %d ]", e.Family, e.TableFamily, e.RegPort)
+	case *expr.Socket:
+		return fmt.Sprintf("[ socket load %d level %d => reg %d ]", e.Key, e.Level, e.Register)
+	default:
+		return fmt.Sprintf("[ %T %+v ]", e, e)
+	}
+}
+
+// newNFTConn returns a netlink connection to nftables, bound to the provided
+// network namespace if not empty. The returned function releases the
+// namespace handle.
+func newNFTConn(netNs string) (*nftables.Conn, func(), error) {
+	if netNs == "" {
+		conn, err := nftables.New()
+		return conn, func() {}, err
+	}
+
+	ns, err := os.Open(netNs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open network namespace %s: %w", netNs, err)
+	}
+
+	conn, err := nftables.New(nftables.WithNetNSFd(int(ns.Fd())))
+	if err != nil {
+		_ = ns.Close()
+		return nil, nil, err
+	}
+
+	return conn, func() { _ = ns.Close() }, nil
+}
+
+// nftBaseChains holds the base chains of the inet table standing in for the
+// builtin iptables chains, indexed by iptables table and chain name. Since
+// all of them live in the same table, the ones not in the nat table get
+// prefixed with their iptables table name.
+var nftBaseChains = map[string]map[string]nftables.Chain{
+	TableNAT: {
+		IptablesPreroutingChainName: {
+			Name:     IptablesPreroutingChainName,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+		},
+		IptablesOutputChainName: {
+			Name:     IptablesOutputChainName,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityNATDest,
+		},
+	},
+	TableMangle: {
+		IptablesPreroutingChainName: {
+			Name:     "MANGLE_PREROUTING",
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityMangle,
+		},
+	},
+}
+
+// makeNFTRules translates the ruleset into nftables rules. Since nftables has
+// no multiport match, a rule matching several destination ports is expanded
+// into one rule per port or port range. When ipv6 is not set, the jumps from
+// the base chains only apply to IPv4 traffic.
+func makeNFTRules(ruleset *Ruleset, ipv6 bool) ([]*nftRule, error) {
+	rules := make([]*nftRule, 0)
+	for _, chain := range ruleset.Chains {
+		base, ok := nftBaseChains[chain.Table][chain.Jump.Chain]
+		if !ok {
+			return nil, fmt.Errorf("chain %s of table %s is not supported by nftables", chain.Jump.Chain, chain.Table)
+		}
+
+		for _, rule := range chain.Rules {
+			nftRules, err := makeNFTRule(rule)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, nftRules...)
+		}
+
+		jump := newNFTRule(base.Name, chain.Jump.Comment)
+		if !ipv6 {
+			jump.match("meta nfproto ipv4", matchMeta(expr.MetaKeyNFPROTO, []byte{unix.NFPROTO_IPV4})...)
+		}
+		rules = append(rules, jump.match(fmt.Sprintf("jump %s", chain.Jump.Target), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Jump.Target}))
+	}
+	return rules, nil
+}
+
+// makeNFTRule translates a single rule, which results in multiple nftables
+// rules when it matches several destination ports.
+func makeNFTRule(rule Rule) ([]*nftRule, error) {
+	// a nil range stands for no destination port match
+	portRanges := make([]*util.PortRange, 0)
+	if rule.DestinationPort > 0 {
+		portRanges = append(portRanges, &util.PortRange{LowerBound: rule.DestinationPort, UpperBound: rule.DestinationPort})
+	}
+	for _, destination := range rule.DestinationPorts {
+		portRange, err := util.ParsePortRange(strings.Replace(destination, ":", "-", 1))
+		if err != nil {
+			return nil, err
+		}
+		portRanges = append(portRanges, &portRange)
+	}
+	if len(portRanges) == 0 {
+		portRanges = append(portRanges, nil)
+	}
+
+	protocols := map[string]byte{"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP}
+	rules := make([]*nftRule, 0, len(portRanges))
+	for _, portRange := range portRanges {
+		r := newNFTRule(rule.Chain, rule.Comment)
+
+		if rule.Source != "" {
+			if err := matchNFTAddress(r, rule.Source, false); err != nil {
+				return nil, err
+			}
+		}
+
+		if rule.Destination != "" {
+			if err := matchNFTAddress(r, rule.Destination, true); err != nil {
+				return nil, err
+			}
+		}
+
+		if rule.InInterface != "" {
+			r.match(fmt.Sprintf("iifname \"%s\"", rule.InInterface), matchMeta(expr.MetaKeyIIFNAME, ifname(rule.InInterface))...)
+		}
+
+		if rule.OutInterface != "" {
+			r.match(fmt.Sprintf("oifname \"%s\"", rule.OutInterface), matchMeta(expr.MetaKeyOIFNAME, ifname(rule.OutInterface))...)
+		}
+
+		if rule.Protocol != "" && rule.Protocol != "all" {
+			proto, ok := protocols[rule.Protocol]
+			if !ok {
+				return nil, fmt.Errorf("protocol %s is not supported by nftables", rule.Protocol)
+			}
+			exprs := matchMeta(expr.MetaKeyL4PROTO, []byte{proto})
+			if rule.Set != nil && rule.Set.Type == SetTypePort {
+				r.match(fmt.Sprintf("%s dport @%s", rule.Protocol, rule.Set.Name), append(exprs,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+					&expr.Lookup{SourceRegister: 1, SetName: rule.Set.Name})...)
+			} else if portRange == nil {
+				r.match(fmt.Sprintf("meta l4proto %s", rule.Protocol), exprs...)
+			} else {
+				destination := strings.Replace(asDestination(*portRange), ":", "-", 1)
+				r.match(fmt.Sprintf("%s dport %s", rule.Protocol, destination), append(exprs, matchDestinationPortRange(*portRange)...)...)
+			}
+		}
+
+		if rule.Set != nil && rule.Set.Type == SetTypeNet {
+			matchNFTAddressSet(r, *rule.Set, rule.SetDirection == SetMatchDestination)
+		}
+
+		if rule.UIDOwner > 0 {
+			r.match(fmt.Sprintf("meta skuid %d", rule.UIDOwner), matchMeta(expr.MetaKeySKUID, binaryutil.NativeEndian.PutUint32(uint32(rule.UIDOwner)))...)
+		}
+
+		if rule.GIDOwner > 0 {
+			r.match(fmt.Sprintf("meta skgid %d", rule.GIDOwner), matchMeta(expr.MetaKeySKGID, binaryutil.NativeEndian.PutUint32(uint32(rule.GIDOwner)))...)
+		}
+
+		if rule.CgroupPath != "" {
+			if err := matchNFTCgroup(r, rule.CgroupPath); err != nil {
+				return nil, err
+			}
+		}
+
+		if rule.PacketMark > 0 {
+			r.match(fmt.Sprintf("meta mark 0x%x", rule.PacketMark), matchMeta(expr.MetaKeyMARK, binaryutil.NativeEndian.PutUint32(uint32(rule.PacketMark)))...)
+		}
+
+		switch rule.Target {
+		case TargetReturn:
+			r.match("return", &expr.Verdict{Kind: expr.VerdictReturn})
+		case TargetRedirect:
+			r.match(fmt.Sprintf("redirect to :%d", rule.ToPort),
+				&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(rule.ToPort))},
+				&expr.Redir{RegisterProtoMin: 1})
+		case TargetTProxy:
+			// tproxy only lets the evaluation continue when the proxy socket is
+			// found, so the mark is only set on the packets it intercepted
+			r.match(fmt.Sprintf("tproxy to :%d", rule.ToPort),
+				&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(rule.ToPort))},
+				&expr.TProxy{Family: unix.NFPROTO_UNSPEC, TableFamily: unix.NFPROTO_INET, RegPort: 1})
+			r.match(fmt.Sprintf("meta mark set 0x%x", rule.Mark),
+				&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(rule.Mark))},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1})
+		default:
+			r.match(fmt.Sprintf("jump %s", rule.Target), &expr.Verdict{Kind: expr.VerdictJump, Chain: rule.Target})
+		}
+
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matchNFTAddress matches the source or destination address of the packet
+// against the subnet, restricting the rule to the subnet's IP family.
+func matchNFTAddress(rule *nftRule, subnet string, destination bool) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+
+	direction := "saddr"
+	family, offset, ip := byte(unix.NFPROTO_IPV4), uint32(12), ipNet.IP.To4()
+	if ip == nil {
+		family, offset, ip = unix.NFPROTO_IPV6, 8, ipNet.IP.To16()
+	}
+	if destination {
+		// the destination address follows the source address
+		direction = "daddr"
+		offset += uint32(len(ip))
+	}
+
+	text := fmt.Sprintf("ip %s %s", direction, ipNet)
+	if family == unix.NFPROTO_IPV6 {
+		text = fmt.Sprintf("ip6 %s %s", direction, ipNet)
+	}
+
+	rule.match(text,
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: ipNet.Mask, Xor: make([]byte, len(ip))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip})
+	return nil
+}
+
+// matchNFTAddressSet matches the source or destination address of the packet
+// against the subnets of the set, restricting the rule to the set's IP
+// family.
+func matchNFTAddressSet(rule *nftRule, set Set, destination bool) {
+	direction := "saddr"
+	family, offset, size := byte(unix.NFPROTO_IPV4), uint32(12), uint32(net.IPv4len)
+	if set.IPv6 {
+		family, offset, size = unix.NFPROTO_IPV6, 8, net.IPv6len
+	}
+	if destination {
+		direction = "daddr"
+		offset += size
+	}
+
+	text := fmt.Sprintf("ip %s @%s", direction, set.Name)
+	if set.IPv6 {
+		text = fmt.Sprintf("ip6 %s @%s", direction, set.Name)
+	}
+
+	rule.match(text,
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name})
+}
+
+// matchNFTCgroup matches the sockets of the processes in the cgroup. Unlike
+// iptables, nftables doesn't resolve the path itself but expects the cgroup
+// ID, which is the inode number of its directory, along with its depth in the
+// hierarchy.
+func matchNFTCgroup(rule *nftRule, path string) error {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+
+	var stat unix.Stat_t
+	if err := unix.Stat(filepath.Join(cgroupRoot, path), &stat); err != nil {
+		return fmt.Errorf("could not resolve cgroup %s: %w", path, err)
+	}
+
+	level := 0
+	if path != "" {
+		level = len(strings.Split(path, "/"))
+	}
+
+	rule.match(fmt.Sprintf("socket cgroupv2 level %d \"%s\"", level, path),
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: uint32(level), Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint64(stat.Ino)})
+	return nil
+}
+
+// matchMeta loads the meta key into the first register and compares it
+// against the provided data.
+func matchMeta(key expr.MetaKey, data []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// matchDestinationPortRange compares the transport header destination port
+// against the range; the transport protocol must be matched beforehand.
+func matchDestinationPortRange(portRange util.PortRange) []expr.Any {
+	exprs := []expr.Any{&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}}
+	if portRange.LowerBound == portRange.UpperBound {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(portRange.LowerBound))})
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(uint16(portRange.LowerBound)),
+		ToData:   binaryutil.BigEndian.PutUint16(uint16(portRange.UpperBound)),
+	})
+}
+
+// ifname pads the interface name to the size used by the kernel.
+func ifname(name string) []byte {
+	b := make([]byte, ifNameSize)
+	copy(b, name)
+	return b
+}
+
+// nftSet is a Set translated into an nftables interval set, holding the
+// merged intervals of its elements.
+type nftSet struct {
+	name      string
+	keyType   nftables.SetDatatype
+	intervals []nftInterval
+	text      []string
+}
+
+// nftInterval is the interval of keys from start included to end excluded;
+// end is nil when the interval reaches the end of the key space.
+type nftInterval struct {
+	start []byte
+	end   []byte
+}
+
+// makeNFTSet translates the set into an interval set. Since nftables rejects
+// overlapping intervals, the elements are merged first.
+func makeNFTSet(set Set) (*nftSet, error) {
+	s := &nftSet{name: set.Name, keyType: nftables.TypeInetService}
+	if set.Type == SetTypeNet {
+		s.keyType = nftables.TypeIPAddr
+		if set.IPv6 {
+			s.keyType = nftables.TypeIP6Addr
+		}
+	}
+
+	intervals := make([]nftInterval, 0, len(set.Elements))
+	for _, element := range set.Elements {
+		var interval nftInterval
+		if set.Type == SetTypePort {
+			portRange, err := util.ParsePortRange(element)
+			if err != nil {
+				return nil, err
+			}
+			interval.start = binaryutil.BigEndian.PutUint16(uint16(portRange.LowerBound))
+			interval.end = nextKey(binaryutil.BigEndian.PutUint16(uint16(portRange.UpperBound)))
+		} else {
+			_, ipNet, err := net.ParseCIDR(element)
+			if err != nil {
+				return nil, err
+			}
+			ip := ipNet.IP.To4()
+			if set.IPv6 {
+				ip = ipNet.IP.To16()
+			}
+			if ip == nil || (set.IPv6 && ipNet.IP.To4() != nil) {
+				return nil, fmt.Errorf("subnet %s doesn't belong to the IP family of set %s", element, set.Name)
+			}
+			last := make([]byte, len(ip))
+			for i := range ip {
+				last[i] = ip[i] | ^ipNet.Mask[i]
+			}
+			interval.start = ip
+			interval.end = nextKey(last)
+		}
+		intervals = append(intervals, interval)
+		s.text = append(s.text, element)
+	}
+
+	sort.Slice(intervals, func(i, j int) bool { return bytes.Compare(intervals[i].start, intervals[j].start) < 0 })
+	for _, interval := range intervals {
+		last := len(s.intervals) - 1
+		if last >= 0 && (s.intervals[last].end == nil || bytes.Compare(interval.start, s.intervals[last].end) <= 0) {
+			if s.intervals[last].end != nil && (interval.end == nil || bytes.Compare(interval.end, s.intervals[last].end) > 0) {
+				s.intervals[last].end = interval.end
+			}
+			continue
+		}
+		s.intervals = append(s.intervals, interval)
+	}
+
+	return s, nil
+}
+
+// elements returns the elements of the interval set, each interval being
+// described by its start and, unless it reaches the end of the key space, by
+// the end marker following it.
+func (s *nftSet) elements() []nftables.SetElement {
+	elements := make([]nftables.SetElement, 0, 2*len(s.intervals))
+	for _, interval := range s.intervals {
+		elements = append(elements, nftables.SetElement{Key: interval.start})
+		if interval.end != nil {
+			elements = append(elements, nftables.SetElement{Key: interval.end, IntervalEnd: true})
+		}
+	}
+	return elements
+}
+
+// String renders the set using the nft command line syntax.
+func (s *nftSet) String() string {
+	return fmt.Sprintf("add set inet %s %s { type %s; flags interval; elements = { %s } }",
+		NFTablesTableName, s.name, s.keyType.Name, strings.Join(s.text, ", "))
+}
+
+// nextKey returns the key following the provided one, or nil when it's the
+// last key.
+func nextKey(key []byte) []byte {
+	next := append([]byte{}, key...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+)
+
+func TestMakeNFTRules(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		fc        FirewallConfiguration
+		wantRules []string
+	}{
+		{
+			name: "redirect all, IPv4 only",
+			fc: FirewallConfiguration{
+				Mode:                 RedirectAllMode,
+				InboundPortsToIgnore: []string{"4190-4191", "notanumber"},
+				SubnetsToIgnore:      []string{"10.0.0.1/8"},
+				ProxyInboundPort:     4143,
+				ProxyOutgoingPort:    4140,
+				ProxyUID:             2102,
+			},
+			wantRules: []string{
+				`add rule inet proxy_init PROXY_INIT_REDIRECT tcp dport 4190-4191 return comment "proxy-init/ignore-port-4190:4191"`,
+				`add rule inet proxy_init PROXY_INIT_REDIRECT ip saddr 10.0.0.0/8 return comment "proxy-init/ignore-subnet-10.0.0.1/8"`,
+				`add rule inet proxy_init PROXY_INIT_REDIRECT meta l4proto tcp redirect to :4143 comment "proxy-init/redirect-all-incoming-to-proxy-port"`,
+				`add rule inet proxy_init PREROUTING meta nfproto ipv4 jump PROXY_INIT_REDIRECT comment "proxy-init/install-proxy-init-prerouting"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta skuid 2102 return comment "proxy-init/ignore-proxy-user-id"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT oifname "lo" return comment "proxy-init/ignore-loopback"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta l4proto tcp redirect to :4140 comment "proxy-init/redirect-all-outgoing-to-proxy-port"`,
+				`add rule inet proxy_init OUTPUT meta nfproto ipv4 jump PROXY_INIT_OUTPUT comment "proxy-init/install-proxy-init-output"`,
+			},
+		},
+		{
+			name: "redirect listed, dual-stack",
+			fc: FirewallConfiguration{
+				Mode:                    RedirectListedMode,
+				PortsToRedirectInbound:  []int{8080},
+				OutboundPortsToIgnore:   []string{"443"},
+				SubnetsToIgnore:         []string{"fd00::/8"},
+				OutboundSubnetsToIgnore: []string{"fd00:ec2::254/128", "169.254.169.254/32"},
+				ProxyInboundPort:        4143,
+				ProxyOutgoingPort:       4140,
+				ProxyGID:                2102,
+				ProxyMark:               0x2a,
+				ProxyOutboundDNSPort:    4153,
+				IPv6:                    true,
+			},
+			wantRules: []string{
+				`add rule inet proxy_init PROXY_INIT_REDIRECT ip6 saddr fd00::/8 return comment "proxy-init/ignore-subnet-fd00::/8"`,
+				`add rule inet proxy_init PROXY_INIT_REDIRECT tcp dport 8080 redirect to :4143 comment "proxy-init/redirect-port-8080-to-proxy-port"`,
+				`add rule inet proxy_init PREROUTING jump PROXY_INIT_REDIRECT comment "proxy-init/install-proxy-init-prerouting"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta skgid 2102 return comment "proxy-init/ignore-proxy-group-id"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta mark 0x2a return comment "proxy-init/ignore-proxy-mark"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT oifname "lo" return comment "proxy-init/ignore-loopback"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT tcp dport 443 return comment "proxy-init/ignore-port-443"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT ip6 daddr fd00:ec2::254/128 return comment "proxy-init/ignore-outbound-subnet-fd00:ec2::254/128"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT ip daddr 169.254.169.254/32 return comment "proxy-init/ignore-outbound-subnet-169.254.169.254/32"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT udp dport 53 redirect to :4153 comment "proxy-init/redirect-dns-udp-to-proxy-port"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT tcp dport 53 redirect to :4153 comment "proxy-init/redirect-dns-tcp-to-proxy-port"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta l4proto tcp redirect to :4140 comment "proxy-init/redirect-all-outgoing-to-proxy-port"`,
+				`add rule inet proxy_init OUTPUT jump PROXY_INIT_OUTPUT comment "proxy-init/install-proxy-init-output"`,
+			},
+		},
+		{
+			name: "tproxy, IPv4 only",
+			fc: FirewallConfiguration{
+				Mode:                    RedirectAllMode,
+				ProxyInboundPort:        4143,
+				ProxyOutgoingPort:       4140,
+				InboundInterceptionMode: InboundInterceptionModeTProxy,
+			},
+			wantRules: []string{
+				`add rule inet proxy_init PROXY_INIT_TPROXY iifname "lo" return comment "proxy-init/ignore-loopback"`,
+				`add rule inet proxy_init PROXY_INIT_TPROXY meta l4proto tcp tproxy to :4143 meta mark set 0x539 comment "proxy-init/tproxy-all-incoming-to-proxy-port"`,
+				`add rule inet proxy_init MANGLE_PREROUTING meta nfproto ipv4 jump PROXY_INIT_TPROXY comment "proxy-init/install-proxy-init-tproxy"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT oifname "lo" return comment "proxy-init/ignore-loopback"`,
+				`add rule inet proxy_init PROXY_INIT_OUTPUT meta l4proto tcp redirect to :4140 comment "proxy-init/redirect-all-outgoing-to-proxy-port"`,
+				`add rule inet proxy_init OUTPUT meta nfproto ipv4 jump PROXY_INIT_OUTPUT comment "proxy-init/install-proxy-init-output"`,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			nftRules, err := makeNFTRules(tt.fc.Ruleset(), tt.fc.IPv6)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			rules := make([]string, 0)
+			for _, rule := range nftRules {
+				rules = append(rules, rule.String())
+			}
+			assertEqual(t, rules, tt.wantRules)
+		})
+	}
+}
+
+func TestMakeNFTRules_Cgroup(t *testing.T) {
+	root := cgroupRoot
+	defer func() { cgroupRoot = root }()
+	cgroupRoot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cgroupRoot, "kubepods", "pod1234", "proxy"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fc := FirewallConfiguration{ProxyOutgoingPort: 4140, ProxyCgroupPath: "/kubepods/pod1234/proxy"}
+	rules, err := makeNFTRule(fc.Ruleset().Chains[1].Rules[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertEqual(t, rules[0].String(), `add rule inet proxy_init PROXY_INIT_OUTPUT socket cgroupv2 level 3 "kubepods/pod1234/proxy" return comment "proxy-init/ignore-proxy-cgroup"`)
+
+	fc.ProxyCgroupPath = "/kubepods/missing"
+	if _, err := makeNFTRule(fc.Ruleset().Chains[1].Rules[0]); err == nil {
+		t.Fatal("expected an error for a missing cgroup")
+	}
+}
+
+func TestConfigureNFTables_Simulate(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		SimulateOnly:      true,
+		NFTables:          true,
+	}
+
+	if err := ConfigureFirewall(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := CleanupFirewallConfig(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestMakeNFTRules_Sets(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		InboundPortsToIgnore:    []string{"4190-4191"},
+		OutboundSubnetsToIgnore: []string{"169.254.169.254/32", "fd00::/8"},
+		UseSets:                 true,
+		NFTables:                true,
+		IPv6:                    true,
+	}
+	ruleset := fc.Ruleset()
+
+	nftRules, err := makeNFTRules(ruleset, fc.IPv6)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rules := make([]string, 0)
+	for _, rule := range nftRules {
+		rules = append(rules, rule.String())
+	}
+	assertEqual(t, rules, []string{
+		`add rule inet proxy_init PROXY_INIT_REDIRECT tcp dport @PROXY_INIT_IN_PORTS return comment "proxy-init/ignore-port-set-PROXY_INIT_IN_PORTS"`,
+		`add rule inet proxy_init PROXY_INIT_REDIRECT meta l4proto tcp redirect to :4143 comment "proxy-init/redirect-all-incoming-to-proxy-port"`,
+		`add rule inet proxy_init PREROUTING jump PROXY_INIT_REDIRECT comment "proxy-init/install-proxy-init-prerouting"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT oifname "lo" return comment "proxy-init/ignore-loopback"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT ip daddr @PROXY_INIT_OUT_SUBNETS return comment "proxy-init/ignore-subnet-set-PROXY_INIT_OUT_SUBNETS"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT ip6 daddr @PROXY_INIT_OUT_SUBNETS6 return comment "proxy-init/ignore-subnet-set-PROXY_INIT_OUT_SUBNETS6"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT meta l4proto tcp redirect to :4140 comment "proxy-init/redirect-all-outgoing-to-proxy-port"`,
+		`add rule inet proxy_init OUTPUT jump PROXY_INIT_OUTPUT comment "proxy-init/install-proxy-init-output"`,
+	})
+
+	sets := make([]string, 0)
+	for _, set := range ruleset.Sets {
+		nftSet, err := makeNFTSet(set)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		sets = append(sets, nftSet.String())
+	}
+	assertEqual(t, sets, []string{
+		`add set inet proxy_init PROXY_INIT_IN_PORTS { type inet_service; flags interval; elements = { 4190-4191 } }`,
+		`add set inet proxy_init PROXY_INIT_OUT_SUBNETS { type ipv4_addr; flags interval; elements = { 169.254.169.254/32 } }`,
+		`add set inet proxy_init PROXY_INIT_OUT_SUBNETS6 { type ipv6_addr; flags interval; elements = { fd00::/8 } }`,
+	})
+}
+
+func TestMakeNFTSet_MergesIntervals(t *testing.T) {
+	nftSet, err := makeNFTSet(Set{Name: "ports", Type: SetTypePort, Elements: []string{"4191", "4190-4191", "8080-8090", "8085", "65535"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertEqual(t, nftSet.intervals, []nftInterval{
+		{start: []byte{0x10, 0x5e}, end: []byte{0x10, 0x60}},
+		{start: []byte{0x1f, 0x90}, end: []byte{0x1f, 0x9b}},
+		{start: []byte{0xff, 0xff}},
+	})
+	if elements := nftSet.elements(); len(elements) != 5 || !elements[1].IntervalEnd || elements[4].IntervalEnd {
+		t.Fatalf("unexpected elements %+v", elements)
+	}
+
+	nftSet, err = makeNFTSet(Set{Name: "subnets", Type: SetTypeNet, Elements: []string{"10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertEqual(t, nftSet.intervals, []nftInterval{{start: []byte{10, 0, 0, 0}, end: []byte{12, 0, 0, 0}}})
+
+	if _, err := makeNFTSet(Set{Name: "subnets6", Type: SetTypeNet, IPv6: true, Elements: []string{"10.0.0.0/8"}}); err == nil {
+		t.Fatal("expected an error for an IPv4 subnet in an IPv6 set")
+	}
+}
+
+func TestVerifyNFTRules(t *testing.T) {
+	installedConfig := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyUID:          2102,
+	}
+	rules, err := makeNFTRules(installedConfig.Ruleset(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the rules as listed from the kernel, which only keeps their
+	// expressions and comment
+	installed := map[string][]*nftables.Rule{}
+	for _, rule := range rules {
+		installed[rule.chain] = append(installed[rule.chain], &nftables.Rule{
+			Exprs:    rule.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, formatComment(rule.comment)),
+		})
+	}
+
+	if drifts := verifyNFTRules(rules, installed); len(drifts) != 0 {
+		t.Fatalf("expected no drift, got %v", drifts)
+	}
+
+	// same comments, different proxy ports and UID
+	expectedConfig := installedConfig
+	expectedConfig.ProxyInboundPort = 9999
+	expectedConfig.ProxyOutgoingPort = 9998
+	expectedConfig.ProxyUID = 1
+	expected, err := makeNFTRules(expectedConfig.Ruleset(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	drifts := verifyNFTRules(expected, installed)
+	wantMissing := []string{
+		`add rule inet proxy_init PROXY_INIT_REDIRECT meta l4proto tcp redirect to :9999 comment "proxy-init/redirect-all-incoming-to-proxy-port"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT meta skuid 1 return comment "proxy-init/ignore-proxy-user-id"`,
+		`add rule inet proxy_init PROXY_INIT_OUTPUT meta l4proto tcp redirect to :9998 comment "proxy-init/redirect-all-outgoing-to-proxy-port"`,
+	}
+	missing := make([]string, 0)
+	extra := 0
+	for _, drift := range drifts {
+		switch drift.Kind {
+		case DriftMissing:
+			missing = append(missing, drift.Rule)
+		case DriftExtra:
+			extra++
+			if !strings.Contains(drift.Rule, "[ immediate reg 1 ") && !strings.Contains(drift.Rule, "[ meta load skuid => reg 1 ]") {
+				t.Errorf("expected the extra rule to be rendered with its expressions, got %s", drift.Rule)
+			}
+		default:
+			t.Errorf("unexpected drift %s", drift)
+		}
+	}
+	if !reflect.DeepEqual(missing, wantMissing) || extra != len(wantMissing) {
+		t.Fatalf("expected the rules\n%s\nto be missing and replaced, got %v", strings.Join(wantMissing, "\n"), drifts)
+	}
+}
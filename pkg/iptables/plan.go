@@ -0,0 +1,125 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// FamilyIPv4 is the plan family of the iptables IPv4 pass.
+	FamilyIPv4 = "ipv4"
+
+	// FamilyIPv6 is the plan family of the ip6tables IPv6 pass.
+	FamilyIPv6 = "ipv6"
+
+	// FamilyInet is the plan family of the nftables backend, handling both
+	// IPv4 and IPv6 from a single inet table.
+	FamilyInet = "inet"
+)
+
+// Plan is a machine-readable description of the changes ConfigureFirewall
+// would apply, meant to be compared across runs.
+type Plan struct {
+	Family string        `json:"family"`
+	Tables []PlanTable   `json:"tables"`
+	Routes []PolicyRoute `json:"routes,omitempty"`
+	Sets   []Set         `json:"sets,omitempty"`
+	// SubnetsToIgnore and OutboundSubnetsToIgnore are the subnets that
+	// landed in this family.
+	SubnetsToIgnore         []string `json:"subnets-to-ignore,omitempty"`
+	OutboundSubnetsToIgnore []string `json:"outbound-subnets-to-ignore,omitempty"`
+
+	ruleset *Ruleset
+}
+
+// PlanTable holds the chains of a table.
+type PlanTable struct {
+	Name   string      `json:"name"`
+	Chains []PlanChain `json:"chains"`
+}
+
+// PlanChain holds the rules of a chain owned by proxy-init, along with the
+// jump hooking it into a builtin chain.
+type PlanChain struct {
+	Name  string     `json:"name"`
+	Rules []PlanRule `json:"rules"`
+	Jump  PlanRule   `json:"jump"`
+}
+
+// PlanRule is a rule rendered in the iptables-save syntax, along with its
+// comment.
+type PlanRule struct {
+	Chain   string `json:"chain"`
+	Rule    string `json:"rule"`
+	Comment string `json:"comment"`
+}
+
+// NewPlan returns the plan of the rules the configuration results in.
+func NewPlan(fc FirewallConfiguration) *Plan {
+	ruleset := fc.Ruleset()
+
+	plan := &Plan{
+		Family:                  FamilyIPv4,
+		Tables:                  make([]PlanTable, 0),
+		Routes:                  ruleset.Routes,
+		Sets:                    ruleset.Sets,
+		SubnetsToIgnore:         fc.SubnetsToIgnore,
+		OutboundSubnetsToIgnore: fc.OutboundSubnetsToIgnore,
+		ruleset:                 ruleset,
+	}
+	if fc.NFTables {
+		plan.Family = FamilyInet
+	} else if fc.IPv6 {
+		plan.Family = FamilyIPv6
+	}
+
+	for _, table := range ruleset.Tables() {
+		planTable := PlanTable{Name: table, Chains: make([]PlanChain, 0)}
+		for _, chain := range ruleset.Chains {
+			if chain.Table != table {
+				continue
+			}
+			planChain := PlanChain{Name: chain.Name, Rules: make([]PlanRule, 0, len(chain.Rules)), Jump: newPlanRule(chain.Jump)}
+			for _, rule := range chain.Rules {
+				planChain.Rules = append(planChain.Rules, newPlanRule(rule))
+			}
+			planTable.Chains = append(planTable.Chains, planChain)
+		}
+		plan.Tables = append(plan.Tables, planTable)
+	}
+
+	return plan
+}
+
+func newPlanRule(rule Rule) PlanRule {
+	return PlanRule{Chain: rule.Chain, Rule: rule.String(), Comment: formatComment(rule.Comment)}
+}
+
+// RestoreText renders the plan as an iptables-restore payload, preceded by a
+// comment stating its family. Subnets, routes and the ipset restore payload
+// of the sets are rendered as comments, since they are not part of the
+// payload.
+func (p *Plan) RestoreText() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "# family: %s\n", p.Family)
+	if len(p.SubnetsToIgnore) > 0 {
+		fmt.Fprintf(&text, "# subnets-to-ignore: %s\n", strings.Join(p.SubnetsToIgnore, ","))
+	}
+	if len(p.OutboundSubnetsToIgnore) > 0 {
+		fmt.Fprintf(&text, "# outbound-subnets-to-ignore: %s\n", strings.Join(p.OutboundSubnetsToIgnore, ","))
+	}
+	for _, route := range p.Routes {
+		family := FamilyIPv4
+		if route.IPv6 {
+			family = FamilyIPv6
+		}
+		fmt.Fprintf(&text, "# route: %s fwmark 0x%x lookup %d\n", family, route.Mark, route.Table)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(makeIPSetPayload(p.Sets)), "\n") {
+		if line != "" {
+			fmt.Fprintf(&text, "# ipset: %s\n", line)
+		}
+	}
+	text.WriteString(makeRestorePayload(p.ruleset, nil))
+	return text.String()
+}
@@ -0,0 +1,60 @@
+package iptables
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewPlan(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                  RedirectAllMode,
+		OutboundPortsToIgnore: []string{"443"},
+		ProxyInboundPort:      4143,
+		ProxyOutgoingPort:     4140,
+		IPv6:                  true,
+	}
+
+	plan := NewPlan(fc)
+	out, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertEqual(t, string(out), `{"family":"ipv6","tables":[{"name":"nat","chains":[`+
+		`{"name":"PROXY_INIT_REDIRECT","rules":[`+
+		`{"chain":"PROXY_INIT_REDIRECT","rule":"-A PROXY_INIT_REDIRECT -p tcp -m comment --comment \"proxy-init/redirect-all-incoming-to-proxy-port\" -j REDIRECT --to-ports 4143","comment":"proxy-init/redirect-all-incoming-to-proxy-port"}],`+
+		`"jump":{"chain":"PREROUTING","rule":"-A PREROUTING -m comment --comment \"proxy-init/install-proxy-init-prerouting\" -j PROXY_INIT_REDIRECT","comment":"proxy-init/install-proxy-init-prerouting"}},`+
+		`{"name":"PROXY_INIT_OUTPUT","rules":[`+
+		`{"chain":"PROXY_INIT_OUTPUT","rule":"-A PROXY_INIT_OUTPUT -o lo -m comment --comment \"proxy-init/ignore-loopback\" -j RETURN","comment":"proxy-init/ignore-loopback"},`+
+		`{"chain":"PROXY_INIT_OUTPUT","rule":"-A PROXY_INIT_OUTPUT -p tcp -m multiport --dports 443 -m comment --comment \"proxy-init/ignore-port-443\" -j RETURN","comment":"proxy-init/ignore-port-443"},`+
+		`{"chain":"PROXY_INIT_OUTPUT","rule":"-A PROXY_INIT_OUTPUT -p tcp -m comment --comment \"proxy-init/redirect-all-outgoing-to-proxy-port\" -j REDIRECT --to-ports 4140","comment":"proxy-init/redirect-all-outgoing-to-proxy-port"}],`+
+		`"jump":{"chain":"OUTPUT","rule":"-A OUTPUT -m comment --comment \"proxy-init/install-proxy-init-output\" -j PROXY_INIT_OUTPUT","comment":"proxy-init/install-proxy-init-output"}}]}]}`)
+}
+
+func TestPlanRestoreText(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                    RedirectAllMode,
+		ProxyInboundPort:        4143,
+		ProxyOutgoingPort:       4140,
+		InboundInterceptionMode: InboundInterceptionModeTProxy,
+		OutboundSubnetsToIgnore: []string{"169.254.169.254/32"},
+	}
+
+	assertEqual(t, NewPlan(fc).RestoreText(), `# family: ipv4
+# outbound-subnets-to-ignore: 169.254.169.254/32
+# route: ipv4 fwmark 0x539 lookup 133
+*mangle
+:PROXY_INIT_TPROXY - [0:0]
+-A PROXY_INIT_TPROXY -i lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_TPROXY -p tcp -m comment --comment "proxy-init/tproxy-all-incoming-to-proxy-port" -j TPROXY --on-port 4143 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-tproxy" -j PROXY_INIT_TPROXY
+COMMIT
+*nat
+:PROXY_INIT_OUTPUT - [0:0]
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -d 169.254.169.254/32 -m comment --comment "proxy-init/ignore-outbound-subnet-169.254.169.254/32" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+COMMIT
+`)
+}
@@ -87,3 +87,33 @@ func TestResolveBinFallback_NoCandidates(t *testing.T) {
 		t.Fatalf("expected no change when no candidates found, got bin=%q save=%q", fc.BinPath, fc.SaveBinPath)
 	}
 }
+
+func TestResolveBinFallback_RestoreSibling(t *testing.T) {
+	fc := &FirewallConfiguration{BinPath: "ip6tables-missing", SaveBinPath: "ip6tables-missing-save"}
+	lp := fakeLookPath([]string{
+		"ip6tables-nft",
+		"ip6tables-nft-save",
+		"ip6tables-nft-restore",
+	})
+
+	resolveBinFallback(fc, lp)
+
+	if fc.RestoreBinPath != "ip6tables-nft-restore" {
+		t.Fatalf("expected restore binary to follow the save binary fallback, got restore=%q", fc.RestoreBinPath)
+	}
+}
+
+func TestResolveBinFallback_RestoreKeepWhenPresent(t *testing.T) {
+	fc := &FirewallConfiguration{BinPath: "iptables-legacy", SaveBinPath: "iptables-legacy-save"}
+	lp := fakeLookPath([]string{
+		"iptables-legacy",
+		"iptables-legacy-save",
+		"iptables-legacy-restore",
+	})
+
+	resolveBinFallback(fc, lp)
+
+	if fc.RestoreBinPath != "iptables-legacy-restore" {
+		t.Fatalf("expected iptables-legacy-restore, got restore=%q", fc.RestoreBinPath)
+	}
+}
@@ -0,0 +1,89 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicyRoute is a policy routing rule sending the packets carrying Mark to
+// Table, along with the route of that table delivering them locally.
+type PolicyRoute struct {
+	Mark  int  `json:"mark"`
+	Table int  `json:"table"`
+	IPv6  bool `json:"ipv6"`
+}
+
+// makePolicyRoutes returns the routes delivering locally the packets carrying
+// the mark. The nftables backend handles both IP families in a single pass,
+// while the iptables backends are invoked once per family.
+func (fc FirewallConfiguration) makePolicyRoutes(mark int) []PolicyRoute {
+	table := fc.TProxyRouteTable
+	if table == 0 {
+		table = DefaultTProxyRouteTable
+	}
+
+	if !fc.NFTables {
+		return []PolicyRoute{{Mark: mark, Table: table, IPv6: fc.IPv6}}
+	}
+
+	routes := []PolicyRoute{{Mark: mark, Table: table}}
+	if fc.IPv6 {
+		routes = append(routes, PolicyRoute{Mark: mark, Table: table, IPv6: true})
+	}
+	return routes
+}
+
+func (fc FirewallConfiguration) makeIP(route PolicyRoute, args ...string) *exec.Cmd {
+	if route.IPv6 {
+		args = append([]string{"-6"}, args...)
+	}
+	return exec.Command("ip", args...)
+}
+
+func (fc FirewallConfiguration) makeRuleArgs(route PolicyRoute) []string {
+	return []string{"fwmark", fmt.Sprintf("0x%x", route.Mark), "lookup", strconv.Itoa(route.Table)}
+}
+
+func (fc FirewallConfiguration) makeRouteArgs(route PolicyRoute) []string {
+	return []string{"local", "default", "dev", "lo", "table", strconv.Itoa(route.Table)}
+}
+
+// configureRoutes installs the routes. Any previous policy rule for the same
+// mark and table is removed first, so running it again doesn't duplicate it.
+func configureRoutes(fc FirewallConfiguration, routes []PolicyRoute) error {
+	for _, route := range routes {
+		_, _ = executeCommand(fc, fc.makeIP(route, append([]string{"rule", "del"}, fc.makeRuleArgs(route)...)...))
+
+		for _, cmd := range []*exec.Cmd{
+			fc.makeIP(route, append([]string{"rule", "add"}, fc.makeRuleArgs(route)...)...),
+			fc.makeIP(route, append([]string{"route", "replace"}, fc.makeRouteArgs(route)...)...),
+		} {
+			if _, err := executeCommand(fc, cmd); err != nil {
+				if !fc.ContinueOnError {
+					return err
+				}
+
+				log.Debugf("continuing despite error: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cleanupRoutes removes the routes, skipping the ones already absent.
+func cleanupRoutes(fc FirewallConfiguration, routes []PolicyRoute) {
+	for _, route := range routes {
+		for _, cmd := range []*exec.Cmd{
+			fc.makeIP(route, append([]string{"rule", "del"}, fc.makeRuleArgs(route)...)...),
+			fc.makeIP(route, append([]string{"route", "del"}, fc.makeRouteArgs(route)...)...),
+		} {
+			if _, err := executeCommand(fc, cmd); err != nil {
+				log.Debugf("ignoring error, the route is likely gone already: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	util "github.com/linkerd/linkerd2-proxy-init/pkg/util"
+)
+
+const (
+	// TableNAT is the table holding the redirection rules.
+	TableNAT = "nat"
+
+	// TableMangle is the table holding the TPROXY rules.
+	TableMangle = "mangle"
+
+	// TargetReturn stops traversing the current chain, so the packet is not
+	// redirected.
+	TargetReturn = "RETURN"
+
+	// TargetRedirect redirects the packet to a local port.
+	TargetRedirect = "REDIRECT"
+
+	// TargetTProxy delivers the packet to a local port without rewriting its
+	// destination, marking it so it's routed locally.
+	TargetTProxy = "TPROXY"
+
+	dnsPort = 53
+)
+
+// Rule is a single firewall rule, independent of the backend used to apply
+// it. Unset fields don't take part in the match.
+type Rule struct {
+	// Chain the rule belongs to.
+	Chain string
+	// Source subnet, in CIDR notation.
+	Source string
+	// Destination subnet, in CIDR notation.
+	Destination string
+	// InInterface is the name of the interface the packet is received from.
+	InInterface string
+	// OutInterface is the name of the interface the packet is sent through.
+	OutInterface string
+	// Protocol is the transport protocol, such as "tcp".
+	Protocol string
+	// UIDOwner matches packets sent by sockets owned by this user ID.
+	UIDOwner int
+	// GIDOwner matches packets sent by sockets owned by this group ID.
+	GIDOwner int
+	// CgroupPath matches packets sent by sockets of processes in this cgroup
+	// v2, relative to the root of the cgroup hierarchy.
+	CgroupPath string
+	// PacketMark matches packets carrying this fwmark, such as the one set by
+	// the sending socket through SO_MARK.
+	PacketMark int
+	// Set matches packets whose destination port, or address according to
+	// SetDirection, belongs to the set.
+	Set *Set
+	// SetDirection is either SetMatchSource or SetMatchDestination.
+	SetDirection string
+	// DestinationPort is a single destination port.
+	DestinationPort int
+	// DestinationPorts are destination ports and port ranges (as
+	// "lower:upper"), up to IptablesMultiportLimit ports.
+	DestinationPorts []string
+	// Comment describes the rule; it's prefixed with "proxy-init/" when
+	// rendered.
+	Comment string
+	// Target is either TargetReturn, TargetRedirect or the name of a chain to
+	// jump to.
+	Target string
+	// ToPort is the port TargetRedirect and TargetTProxy redirect to.
+	ToPort int
+	// ToAddress is the address TargetTProxy redirects to.
+	ToAddress string
+	// Mark is the fwmark TargetTProxy sets.
+	Mark int
+}
+
+// Chain is a chain owned by proxy-init, along with the rule hooking it into
+// one of the builtin chains.
+type Chain struct {
+	// Table the chain belongs to.
+	Table string
+	// Name of the chain.
+	Name string
+	// Rules of the chain, in order. They replace any rule already present.
+	Rules []Rule
+	// Jump is the rule sending traffic from a builtin chain to this chain. It
+	// is only installed when not already present.
+	Jump Rule
+}
+
+// Ruleset is the set of chains proxy-init installs for a
+// FirewallConfiguration. Backends are responsible for applying it.
+type Ruleset struct {
+	Chains []Chain
+	// Routes deliver locally the packets marked by TargetTProxy rules.
+	Routes []PolicyRoute
+	// Sets hold the ports and subnets matched by the rules, when
+	// FirewallConfiguration.UseSets is enabled.
+	Sets []Set
+}
+
+// Tables returns the names of the tables the ruleset operates on, in order of
+// first appearance.
+func (rs *Ruleset) Tables() []string {
+	tables := make([]string, 0)
+	seen := map[string]struct{}{}
+	for _, chain := range rs.Chains {
+		if _, ok := seen[chain.Table]; !ok {
+			seen[chain.Table] = struct{}{}
+			tables = append(tables, chain.Table)
+		}
+	}
+	return tables
+}
+
+// Args renders the rule as iptables arguments, in the canonical order used by
+// iptables-save, prefixed by the provided action ("-A" or "-D").
+func (r Rule) Args(action string) []string {
+	args := []string{action, r.Chain}
+	if r.Source != "" {
+		args = append(args, "-s", r.Source)
+	}
+	if r.Destination != "" {
+		args = append(args, "-d", r.Destination)
+	}
+	if r.InInterface != "" {
+		args = append(args, "-i", r.InInterface)
+	}
+	if r.OutInterface != "" {
+		args = append(args, "-o", r.OutInterface)
+	}
+	if r.Protocol != "" {
+		args = append(args, "-p", r.Protocol)
+	}
+	if r.DestinationPort > 0 {
+		args = append(args, "-m", r.Protocol, "--dport", strconv.Itoa(r.DestinationPort))
+	}
+	if r.UIDOwner > 0 {
+		args = append(args, "-m", "owner", "--uid-owner", strconv.Itoa(r.UIDOwner))
+	}
+	if r.GIDOwner > 0 {
+		args = append(args, "-m", "owner", "--gid-owner", strconv.Itoa(r.GIDOwner))
+	}
+	if r.CgroupPath != "" {
+		args = append(args, "-m", "cgroup", "--path", r.CgroupPath)
+	}
+	if r.PacketMark > 0 {
+		args = append(args, "-m", "mark", "--mark", fmt.Sprintf("0x%x", r.PacketMark))
+	}
+	if len(r.DestinationPorts) > 0 {
+		args = append(args, "-m", "multiport", "--dports", strings.Join(r.DestinationPorts, ","))
+	}
+	if r.Set != nil {
+		args = append(args, "-m", "set", "--match-set", r.Set.Name, r.SetDirection)
+	}
+	if r.Comment != "" {
+		args = append(args, "-m", "comment", "--comment", formatComment(r.Comment))
+	}
+	args = append(args, "-j", r.Target)
+	switch r.Target {
+	case TargetRedirect:
+		args = append(args, "--to-ports", strconv.Itoa(r.ToPort))
+	case TargetTProxy:
+		args = append(args, "--on-port", strconv.Itoa(r.ToPort), "--on-ip", r.ToAddress, "--tproxy-mark", fmt.Sprintf("0x%x/0xffffffff", r.Mark))
+	}
+	return args
+}
+
+// String renders the rule the way iptables-save and iptables-restore do.
+func (r Rule) String() string {
+	args := r.Args("-A")
+	for i, arg := range args {
+		if i > 0 && (args[i-1] == "--comment" || args[i-1] == "--path") {
+			args[i] = saveString(arg)
+		} else if strings.ContainsAny(arg, " \t\"'") {
+			args[i] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// saveString quotes the string argument of a match like iptables-save does
+// through xtables_save_string, unless it only holds letters, digits,
+// underscores and dashes.
+func saveString(value string) string {
+	if value != "" && strings.Trim(value, "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+		return value
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range value {
+		if c == '"' || c == '\\' || c == '\'' {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// Ruleset builds the backend independent set of chains and rules that
+// redirect all desired traffic through the proxy.
+func (fc FirewallConfiguration) Ruleset() *Ruleset {
+	rs := &Ruleset{}
+	fc.addIncomingTrafficRules(rs)
+	fc.addOutgoingTrafficRules(rs)
+	return rs
+}
+
+// formatComment is used to format iptables comments
+func formatComment(text string) string {
+	return fmt.Sprintf("proxy-init/%s", text)
+}
+
+func (fc FirewallConfiguration) addOutgoingTrafficRules(rs *Ruleset) {
+	chain := Chain{Table: TableNAT, Name: outputChainName}
+
+	// Ignore traffic from the proxy
+	if fc.ProxyUID > 0 {
+		chain.Rules = append(chain.Rules, Rule{Chain: outputChainName, UIDOwner: fc.ProxyUID, Comment: "ignore-proxy-user-id", Target: TargetReturn})
+	}
+
+	// Ignore traffic from the proxy
+	if fc.ProxyGID > 0 {
+		chain.Rules = append(chain.Rules, Rule{Chain: outputChainName, GIDOwner: fc.ProxyGID, Comment: "ignore-proxy-group-id", Target: TargetReturn})
+	}
+
+	// Ignore traffic from the proxy container, whatever user it runs as
+	if fc.ProxyCgroupPath != "" {
+		chain.Rules = append(chain.Rules, Rule{Chain: outputChainName, CgroupPath: fc.ProxyCgroupPath, Comment: "ignore-proxy-cgroup", Target: TargetReturn})
+	}
+
+	// Ignore the connections the proxy opted out of redirection
+	if fc.ProxyMark > 0 {
+		chain.Rules = append(chain.Rules, Rule{Chain: outputChainName, PacketMark: fc.ProxyMark, Comment: "ignore-proxy-mark", Target: TargetReturn})
+	}
+
+	// Ignore loopback
+	chain.Rules = append(chain.Rules, Rule{Chain: outputChainName, OutInterface: "lo", Comment: "ignore-loopback", Target: TargetReturn})
+	if fc.UseSets {
+		// Ignore ports and destination subnets
+		chain.Rules = append(chain.Rules, fc.makeIgnoreSets(rs, outputChainName, "PROXY_INIT_OUT", fc.OutboundPortsToIgnore, fc.OutboundSubnetsToIgnore, SetMatchDestination)...)
+	} else {
+		// Ignore ports
+		chain.Rules = append(chain.Rules, makeIgnorePorts(fc.OutboundPortsToIgnore, outputChainName)...)
+		// Ignore destination subnets
+		for _, subnet := range fc.OutboundSubnetsToIgnore {
+			chain.Rules = append(chain.Rules, makeIgnoreDestinationSubnet(outputChainName, subnet, fmt.Sprintf("ignore-outbound-subnet-%s", subnet)))
+		}
+	}
+
+	// Redirect DNS to the proxy
+	if fc.ProxyOutboundDNSPort > 0 {
+		for _, protocol := range []string{"udp", "tcp"} {
+			chain.Rules = append(chain.Rules, makeRedirectChainToPortBasedOnDestinationPort(
+				outputChainName,
+				protocol,
+				dnsPort,
+				fc.ProxyOutboundDNSPort,
+				fmt.Sprintf("redirect-dns-%s-to-proxy-port", protocol)))
+		}
+	}
+
+	chain.Rules = append(chain.Rules, makeRedirectChainToPort(outputChainName, fc.ProxyOutgoingPort, "redirect-all-outgoing-to-proxy-port"))
+
+	// Redirect all remaining outbound traffic to the proxy.
+	chain.Jump = makeJumpFromChainToAnotherForAllProtocols(IptablesOutputChainName, outputChainName, "install-proxy-init-output")
+
+	rs.Chains = append(rs.Chains, chain)
+}
+
+func (fc FirewallConfiguration) addIncomingTrafficRules(rs *Ruleset) {
+	if fc.InboundInterceptionMode == InboundInterceptionModeTProxy {
+		fc.addIncomingTProxyRules(rs)
+		return
+	}
+
+	chain := Chain{Table: TableNAT, Name: redirectChainName}
+
+	chain.Rules = append(chain.Rules, fc.makeIgnoreInboundRules(rs, redirectChainName)...)
+	chain.Rules = append(chain.Rules, fc.makeInboundPortRedirect(redirectChainName)...)
+
+	// Redirect all remaining inbound traffic to the proxy.
+	chain.Jump = makeJumpFromChainToAnotherForAllProtocols(IptablesPreroutingChainName, redirectChainName, "install-proxy-init-prerouting")
+
+	rs.Chains = append(rs.Chains, chain)
+}
+
+// addIncomingTProxyRules delivers inbound traffic to the proxy through TPROXY
+// in the mangle table, so the proxy sees the original destination address.
+// Traffic received from loopback, which includes the connections the proxy
+// makes to the application, is left alone.
+func (fc FirewallConfiguration) addIncomingTProxyRules(rs *Ruleset) {
+	chain := Chain{Table: TableMangle, Name: tproxyChainName}
+
+	mark := fc.TProxyMark
+	if mark == 0 {
+		mark = DefaultTProxyMark
+	}
+	address := "0.0.0.0"
+	if fc.IPv6 {
+		address = "::"
+	}
+
+	chain.Rules = append(chain.Rules, Rule{Chain: tproxyChainName, InInterface: "lo", Comment: "ignore-loopback", Target: TargetReturn})
+	chain.Rules = append(chain.Rules, fc.makeIgnoreInboundRules(rs, tproxyChainName)...)
+
+	if fc.Mode == RedirectAllMode {
+		chain.Rules = append(chain.Rules, Rule{
+			Chain:     tproxyChainName,
+			Protocol:  "tcp",
+			Comment:   "tproxy-all-incoming-to-proxy-port",
+			Target:    TargetTProxy,
+			ToPort:    fc.ProxyInboundPort,
+			ToAddress: address,
+			Mark:      mark,
+		})
+	} else if fc.Mode == RedirectListedMode {
+		for _, port := range fc.PortsToRedirectInbound {
+			chain.Rules = append(chain.Rules, Rule{
+				Chain:           tproxyChainName,
+				Protocol:        "tcp",
+				DestinationPort: port,
+				Comment:         fmt.Sprintf("tproxy-port-%d-to-proxy-port", port),
+				Target:          TargetTProxy,
+				ToPort:          fc.ProxyInboundPort,
+				ToAddress:       address,
+				Mark:            mark,
+			})
+		}
+	}
+
+	// Deliver all remaining inbound traffic to the proxy.
+	chain.Jump = makeJumpFromChainToAnotherForAllProtocols(IptablesPreroutingChainName, tproxyChainName, "install-proxy-init-tproxy")
+
+	rs.Chains = append(rs.Chains, chain)
+	rs.Routes = append(rs.Routes, fc.makePolicyRoutes(mark)...)
+}
+
+func (fc FirewallConfiguration) makeInboundPortRedirect(chainName string) []Rule {
+	rules := make([]Rule, 0)
+	if fc.Mode == RedirectAllMode {
+		// Create a new chain for redirecting inbound and outbound traffic to the proxy port.
+		rules = append(rules, makeRedirectChainToPort(
+			chainName,
+			fc.ProxyInboundPort,
+			"redirect-all-incoming-to-proxy-port"))
+
+	} else if fc.Mode == RedirectListedMode {
+		for _, port := range fc.PortsToRedirectInbound {
+			rules = append(
+				rules,
+				makeRedirectChainToPortBasedOnDestinationPort(
+					chainName,
+					"tcp",
+					port,
+					fc.ProxyInboundPort,
+					fmt.Sprintf("redirect-port-%d-to-proxy-port", port)))
+		}
+	}
+	return rules
+}
+
+// makeIgnoreInboundRules returns the rules ignoring the inbound ports and the
+// source subnets, held by sets when UseSets is enabled, followed by the ones
+// ignoring ports for a source subnet only.
+func (fc FirewallConfiguration) makeIgnoreInboundRules(rs *Ruleset, chainName string) []Rule {
+	var rules []Rule
+	if fc.UseSets {
+		rules = fc.makeIgnoreSets(rs, chainName, "PROXY_INIT_IN", fc.InboundPortsToIgnore, fc.SubnetsToIgnore, SetMatchSource)
+	} else {
+		rules = makeIgnorePorts(fc.InboundPortsToIgnore, chainName)
+		for _, subnet := range fc.SubnetsToIgnore {
+			rules = append(rules, makeIgnoreSubnet(chainName, subnet, fmt.Sprintf("ignore-subnet-%s", subnet)))
+		}
+	}
+
+	for _, candidate := range fc.InboundPortsToIgnoreFromSubnets {
+		portRange, err := util.ParsePortRangeFromSubnet(candidate)
+		if err != nil {
+			log.Errorf("invalid port from subnet configuration of \"%s\": %s", candidate, err)
+			continue
+		}
+		destination := asDestination(portRange.PortRange)
+		rules = append(rules, Rule{
+			Chain:            chainName,
+			Source:           portRange.Subnet.String(),
+			Protocol:         "tcp",
+			DestinationPorts: []string{destination},
+			Comment:          fmt.Sprintf("ignore-port-%s-from-%s", destination, portRange.Subnet),
+			Target:           TargetReturn,
+		})
+	}
+	return rules
+}
+
+func makeIgnorePorts(portsToIgnore []string, chainName string) []Rule {
+	rules := make([]Rule, 0)
+	for _, destinations := range makeMultiportDestinations(portsToIgnore) {
+		if len(destinations) == 0 {
+			continue
+		}
+		rules = append(rules, Rule{
+			Chain:            chainName,
+			Protocol:         "tcp",
+			DestinationPorts: destinations,
+			Comment:          fmt.Sprintf("ignore-port-%s", strings.Join(destinations, ",")),
+			Target:           TargetReturn,
+		})
+	}
+	return rules
+}
+
+func makeIgnoreSubnet(chainName string, subnet string, comment string) Rule {
+	return Rule{Chain: chainName, Source: normalizeSubnet(subnet), Comment: comment, Target: TargetReturn}
+}
+
+func makeIgnoreDestinationSubnet(chainName string, subnet string, comment string) Rule {
+	return Rule{Chain: chainName, Destination: normalizeSubnet(subnet), Comment: comment, Target: TargetReturn}
+}
+
+// normalizeSubnet formats the subnet the way iptables-save reports it;
+// invalid subnets are left as is for iptables to report them.
+func normalizeSubnet(subnet string) string {
+	if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+		return ipNet.String()
+	}
+	return subnet
+}
+
+func makeRedirectChainToPort(chainName string, portToRedirect int, comment string) Rule {
+	return Rule{Chain: chainName, Protocol: "tcp", Comment: comment, Target: TargetRedirect, ToPort: portToRedirect}
+}
+
+func makeRedirectChainToPortBasedOnDestinationPort(chainName string, protocol string, destinationPort int, portToRedirect int, comment string) Rule {
+	return Rule{Chain: chainName, Protocol: protocol, DestinationPort: destinationPort, Comment: comment, Target: TargetRedirect, ToPort: portToRedirect}
+}
+
+func makeJumpFromChainToAnotherForAllProtocols(chainName string, targetChain string, comment string) Rule {
+	return Rule{Chain: chainName, Comment: comment, Target: targetChain}
+}
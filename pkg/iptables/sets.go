@@ -0,0 +1,191 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SetTypePort is the type of the sets holding destination ports and port
+	// ranges.
+	SetTypePort = "bitmap:port"
+
+	// SetTypeNet is the type of the sets holding subnets of a single IP
+	// family.
+	SetTypeNet = "hash:net"
+
+	// SetMatchSource matches a set against the source address of the packet.
+	SetMatchSource = "src"
+
+	// SetMatchDestination matches a set against the destination port or
+	// address of the packet.
+	SetMatchDestination = "dst"
+)
+
+// Set is a named set of ports or subnets referenced by the rules of a
+// Ruleset, materialized as an ipset or as an nftables set depending on the
+// backend.
+type Set struct {
+	Name string `json:"name"`
+	// Type is either SetTypePort or SetTypeNet.
+	Type string `json:"type"`
+	// IPv6 is set when the set holds IPv6 subnets, or belongs to the IPv6
+	// pass of the iptables backends.
+	IPv6 bool `json:"ipv6"`
+	// Elements are ports and port ranges (as "lower-upper"), or subnets in
+	// CIDR notation.
+	Elements []string `json:"elements"`
+}
+
+// makeIgnoreSets returns the rules ignoring the destination ports and the
+// subnets through sets, one rule per set. The subnets are matched against the
+// source or destination address, according to direction, and are split in
+// one set per IP family.
+func (fc FirewallConfiguration) makeIgnoreSets(rs *Ruleset, chainName string, setPrefix string, ports []string, subnets []string, direction string) []Rule {
+	rules := make([]Rule, 0)
+
+	// the iptables backends are invoked once per IP family, and need
+	// distinct sets for each of them
+	suffix := ""
+	if fc.IPv6 && !fc.NFTables {
+		suffix = "6"
+	}
+
+	elements := make([]string, 0, len(ports))
+	for _, portRange := range makePortSet(ports).Ranges() {
+		elements = append(elements, portRange.String())
+	}
+	if len(elements) > 0 {
+		set := &Set{Name: setPrefix + "_PORTS" + suffix, Type: SetTypePort, IPv6: fc.IPv6 && !fc.NFTables, Elements: elements}
+		rs.Sets = append(rs.Sets, *set)
+		rules = append(rules, Rule{
+			Chain:        chainName,
+			Protocol:     "tcp",
+			Set:          set,
+			SetDirection: SetMatchDestination,
+			Comment:      fmt.Sprintf("ignore-port-set-%s", set.Name),
+			Target:       TargetReturn,
+		})
+	}
+
+	ipv4, ipv6 := make([]string, 0), make([]string, 0)
+	for _, subnet := range subnets {
+		ip, _, err := net.ParseCIDR(subnet)
+		// invalid subnets are left for ipset to report them
+		if (err != nil && fc.IPv6) || (err == nil && ip.To4() == nil) {
+			ipv6 = append(ipv6, normalizeSubnet(subnet))
+		} else {
+			ipv4 = append(ipv4, normalizeSubnet(subnet))
+		}
+	}
+	for _, family := range []struct {
+		subnets []string
+		ipv6    bool
+	}{{ipv4, false}, {ipv6, true}} {
+		if len(family.subnets) == 0 {
+			continue
+		}
+		name := setPrefix + "_SUBNETS"
+		if family.ipv6 {
+			name += "6"
+		}
+		set := &Set{Name: name, Type: SetTypeNet, IPv6: family.ipv6, Elements: family.subnets}
+		rs.Sets = append(rs.Sets, *set)
+		rules = append(rules, Rule{
+			Chain:        chainName,
+			Set:          set,
+			SetDirection: direction,
+			Comment:      fmt.Sprintf("ignore-subnet-set-%s", set.Name),
+			Target:       TargetReturn,
+		})
+	}
+
+	return rules
+}
+
+// makeIPSetPayload renders the sets as an ipset restore payload, creating
+// them when absent and replacing their elements.
+func makeIPSetPayload(sets []Set) string {
+	var payload strings.Builder
+	for _, set := range sets {
+		switch set.Type {
+		case SetTypePort:
+			fmt.Fprintf(&payload, "create %s %s range 0-65535\n", set.Name, set.Type)
+		default:
+			family := "inet"
+			if set.IPv6 {
+				family = "inet6"
+			}
+			fmt.Fprintf(&payload, "create %s %s family %s\n", set.Name, set.Type, family)
+		}
+		fmt.Fprintf(&payload, "flush %s\n", set.Name)
+		for _, element := range set.Elements {
+			for _, entry := range ipsetEntries(element) {
+				fmt.Fprintf(&payload, "add %s %s\n", set.Name, entry)
+			}
+		}
+	}
+	return payload.String()
+}
+
+// ipsetEntries returns the entries of an ipset holding the element. hash:net
+// sets reject the /0 prefix, so the whole address space is added as its two
+// /1 halves instead.
+func ipsetEntries(element string) []string {
+	switch element {
+	case "0.0.0.0/0":
+		return []string{"0.0.0.0/1", "128.0.0.0/1"}
+	case "::/0":
+		return []string{"::/1", "8000::/1"}
+	default:
+		return []string{element}
+	}
+}
+
+func (fc FirewallConfiguration) makeIPSetRestore(payload string) *exec.Cmd {
+	cmd := exec.Command("ipset", "restore", "-exist")
+	cmd.Stdin = strings.NewReader(payload)
+	return cmd
+}
+
+func (fc FirewallConfiguration) makeIPSetDestroy(set Set) *exec.Cmd {
+	return exec.Command("ipset", "destroy", set.Name)
+}
+
+// configureSets creates the ipsets, replacing the elements of the ones
+// already present. It must run before the rules referencing them are
+// installed.
+func configureSets(fc FirewallConfiguration, sets []Set) error {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	payload := makeIPSetPayload(sets)
+	for _, line := range strings.Split(strings.TrimSpace(payload), "\n") {
+		log.Info(line)
+	}
+
+	if _, err := executeCommand(fc, fc.makeIPSetRestore(payload)); err != nil {
+		if !fc.ContinueOnError {
+			return err
+		}
+
+		log.Debugf("continuing despite error: %s", err)
+	}
+
+	return nil
+}
+
+// cleanupSets destroys the ipsets, skipping the ones already absent. It must
+// run after the rules referencing them are removed.
+func cleanupSets(fc FirewallConfiguration, sets []Set) {
+	for _, set := range sets {
+		if _, err := executeCommand(fc, fc.makeIPSetDestroy(set)); err != nil {
+			log.Debugf("ignoring error, the set is likely gone already: %s", err)
+		}
+	}
+}
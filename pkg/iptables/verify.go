@@ -0,0 +1,133 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DriftMissing signals an expected rule that is not installed.
+	DriftMissing = "missing"
+
+	// DriftExtra signals an installed rule that is not expected.
+	DriftExtra = "extra"
+
+	// DriftReordered signals an expected rule installed at the wrong position.
+	DriftReordered = "reordered"
+)
+
+// Drift is a difference between the rules installed in a chain and the ones
+// expected from a FirewallConfiguration.
+type Drift struct {
+	Table string
+	Chain string
+	// Kind is one of DriftMissing, DriftExtra or DriftReordered.
+	Kind string
+	// Rule is the rule as rendered by the backend.
+	Rule string
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s rule in chain %s of table %s: %s", d.Kind, d.Chain, d.Table, d.Rule)
+}
+
+// VerifyFirewall compares the rules currently installed against the ones
+// ConfigureFirewall would install, returning the differences found. An empty
+// result means the firewall is configured as expected.
+func VerifyFirewall(firewallConfiguration FirewallConfiguration) ([]Drift, error) {
+	log.Debugf("tracing script execution as [%s]", executionTraceID)
+
+	return firewallConfiguration.backend().Verify(firewallConfiguration.Ruleset())
+}
+
+// verifySaveOutput compares the ruleset against the iptables-save output of
+// each of its tables. Besides the chains owned by proxy-init, only the rules
+// of the builtin chains jumping to them are taken into account.
+func verifySaveOutput(ruleset *Ruleset, existingRules map[string][]byte) []Drift {
+	drifts := make([]Drift, 0)
+	for _, chain := range ruleset.Chains {
+		lines := savedRules(existingRules[chain.Table])
+
+		want := make([]string, 0, len(chain.Rules))
+		for _, rule := range chain.Rules {
+			want = append(want, rule.String())
+		}
+		got := make([]string, 0)
+		for _, line := range lines {
+			if strings.HasPrefix(line, fmt.Sprintf("-A %s ", chain.Name)) {
+				got = append(got, line)
+			}
+		}
+		drifts = append(drifts, diffRules(chain.Table, chain.Name, want, got)...)
+
+		got = make([]string, 0)
+		for _, line := range lines {
+			if jumpExists([]byte(line), chain.Jump) {
+				got = append(got, line)
+			}
+		}
+		drifts = append(drifts, diffRules(chain.Table, chain.Jump.Chain, []string{chain.Jump.String()}, got)...)
+	}
+	return drifts
+}
+
+// savedRules returns the rules of the iptables-save output, skipping chain
+// declarations, comments and table delimiters.
+func savedRules(out []byte) []string {
+	rules := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+// diffRules reports the rules of want absent from got as missing, the rules
+// of got absent from want as extra, and the rules present in both but in a
+// different relative order as reordered. Rules are compared as strings, and
+// duplicates are accounted for.
+func diffRules(table string, chain string, want []string, got []string) []Drift {
+	drifts := make([]Drift, 0)
+
+	available := map[string]int{}
+	for _, rule := range got {
+		available[rule]++
+	}
+	wantCommon := make([]string, 0, len(want))
+	for _, rule := range want {
+		if available[rule] > 0 {
+			available[rule]--
+			wantCommon = append(wantCommon, rule)
+		} else {
+			drifts = append(drifts, Drift{Table: table, Chain: chain, Kind: DriftMissing, Rule: rule})
+		}
+	}
+
+	expected := map[string]int{}
+	for _, rule := range want {
+		expected[rule]++
+	}
+	gotCommon := make([]string, 0, len(got))
+	for _, rule := range got {
+		if expected[rule] > 0 {
+			expected[rule]--
+			gotCommon = append(gotCommon, rule)
+		} else {
+			drifts = append(drifts, Drift{Table: table, Chain: chain, Kind: DriftExtra, Rule: rule})
+		}
+	}
+
+	for i := range gotCommon {
+		if gotCommon[i] != wantCommon[i] {
+			drifts = append(drifts, Drift{Table: table, Chain: chain, Kind: DriftReordered, Rule: gotCommon[i]})
+		}
+	}
+
+	return drifts
+}
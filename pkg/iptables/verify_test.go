@@ -0,0 +1,135 @@
+package iptables
+
+import (
+	"testing"
+)
+
+func TestVerifySaveOutput(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:                 RedirectAllMode,
+		InboundPortsToIgnore: []string{"4190"},
+		ProxyInboundPort:     4143,
+		ProxyOutgoingPort:    4140,
+		ProxyUID:             2102,
+	}
+
+	for _, tt := range []struct {
+		name       string
+		saveOutput string
+		wantDrifts []Drift
+	}{
+		{
+			name: "rules match",
+			saveOutput: `# Generated by iptables-save v1.8.10 on Mon Jan  1 00:00:00 2024
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:PROXY_INIT_OUTPUT - [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A OUTPUT -m comment --comment "some-other-tool" -j RETURN
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+-A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -m comment --comment "proxy-init/ignore-proxy-user-id" -j RETURN
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 4190 -m comment --comment "proxy-init/ignore-port-4190" -j RETURN
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+COMMIT
+`,
+			wantDrifts: []Drift{},
+		},
+		{
+			name: "rules drifted",
+			saveOutput: `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -m comment --comment "proxy-init/ignore-proxy-user-id" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+-A PROXY_INIT_REDIRECT -p tcp -m tcp --dport 8080 -j RETURN
+COMMIT
+`,
+			wantDrifts: []Drift{
+				{Table: TableNAT, Chain: redirectChainName, Kind: DriftMissing, Rule: `-A PROXY_INIT_REDIRECT -p tcp -m multiport --dports 4190 -m comment --comment "proxy-init/ignore-port-4190" -j RETURN`},
+				{Table: TableNAT, Chain: redirectChainName, Kind: DriftExtra, Rule: `-A PROXY_INIT_REDIRECT -p tcp -m tcp --dport 8080 -j RETURN`},
+				{Table: TableNAT, Chain: IptablesPreroutingChainName, Kind: DriftExtra, Rule: `-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT`},
+				{Table: TableNAT, Chain: outputChainName, Kind: DriftReordered, Rule: `-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN`},
+				{Table: TableNAT, Chain: outputChainName, Kind: DriftReordered, Rule: `-A PROXY_INIT_OUTPUT -m owner --uid-owner 2102 -m comment --comment "proxy-init/ignore-proxy-user-id" -j RETURN`},
+				{Table: TableNAT, Chain: IptablesOutputChainName, Kind: DriftMissing, Rule: `-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT`},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			drifts := verifySaveOutput(fc.Ruleset(), map[string][]byte{TableNAT: []byte(tt.saveOutput)})
+			assertEqual(t, drifts, tt.wantDrifts)
+		})
+	}
+}
+
+func TestVerifySaveOutput_CgroupPath(t *testing.T) {
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		ProxyCgroupPath:   "system.slice/linkerd-proxy.service",
+	}
+
+	// iptables-save quotes the path like the comment
+	saveOutput := `*nat
+:PROXY_INIT_OUTPUT - [0:0]
+:PROXY_INIT_REDIRECT - [0:0]
+-A PREROUTING -m comment --comment "proxy-init/install-proxy-init-prerouting" -j PROXY_INIT_REDIRECT
+-A OUTPUT -m comment --comment "proxy-init/install-proxy-init-output" -j PROXY_INIT_OUTPUT
+-A PROXY_INIT_OUTPUT -m cgroup --path "system.slice/linkerd-proxy.service" -m comment --comment "proxy-init/ignore-proxy-cgroup" -j RETURN
+-A PROXY_INIT_OUTPUT -o lo -m comment --comment "proxy-init/ignore-loopback" -j RETURN
+-A PROXY_INIT_OUTPUT -p tcp -m comment --comment "proxy-init/redirect-all-outgoing-to-proxy-port" -j REDIRECT --to-ports 4140
+-A PROXY_INIT_REDIRECT -p tcp -m comment --comment "proxy-init/redirect-all-incoming-to-proxy-port" -j REDIRECT --to-ports 4143
+COMMIT
+`
+	drifts := verifySaveOutput(fc.Ruleset(), map[string][]byte{TableNAT: []byte(saveOutput)})
+	assertEqual(t, drifts, []Drift{})
+}
+
+func TestSaveString(t *testing.T) {
+	for value, expected := range map[string]string{
+		"linkerd-proxy_1":          "linkerd-proxy_1",
+		"/kubepods/pod1234":        `"/kubepods/pod1234"`,
+		"":                         `""`,
+		`a "quoted" path\with'it'`: `"a \"quoted\" path\\with\'it\'"`,
+	} {
+		assertEqual(t, saveString(value), expected)
+	}
+}
+
+func TestVerifyFirewall_Backend(t *testing.T) {
+	backend := NewFakeBackend()
+	fc := FirewallConfiguration{
+		Mode:              RedirectAllMode,
+		ProxyInboundPort:  4143,
+		ProxyOutgoingPort: 4140,
+		Backend:           backend,
+	}
+
+	drifts, err := VerifyFirewall(fc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(drifts) != 5 {
+		t.Fatalf("expected 5 missing rules before configuring, got %v", drifts)
+	}
+
+	if err := ConfigureFirewall(fc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	drifts, err = VerifyFirewall(fc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertEqual(t, drifts, []Drift{})
+}
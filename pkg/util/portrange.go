@@ -2,10 +2,13 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
 
+const maxPort = 65535
+
 // PortRange defines the upper- and lower-bounds for a range of ports.
 type PortRange struct {
 	LowerBound int
@@ -13,9 +16,16 @@ type PortRange struct {
 }
 
 // IsValidPort checks the provided to determine whether or not the port
-// candidate is a valid TCP port number. Valid TCP ports range from 1 to 65535.
+// candidate is within the bounds of a TCP port range, from 0 to 65535. Use
+// IsValidProxyPort for a port something listens on.
 func IsValidPort(port int) bool {
-	return port >= 0 && port <= 65535
+	return port >= 0 && port <= maxPort
+}
+
+// IsValidProxyPort checks whether the port candidate is a port a process can
+// listen on, ranging from 1 to 65535.
+func IsValidProxyPort(port int) bool {
+	return port > 0 && port <= maxPort
 }
 
 // ParsePort parses and verifies the validity of the port candidate.
@@ -27,9 +37,27 @@ func ParsePort(port string) (int, error) {
 	return i, nil
 }
 
+// ParseProxyPort parses and verifies the validity of a port a process
+// listens on, which can't be 0.
+func ParseProxyPort(port string) (int, error) {
+	i, err := strconv.Atoi(port)
+	if err != nil || !IsValidProxyPort(i) {
+		return -1, fmt.Errorf("\"%s\" is not a valid TCP port", port)
+	}
+	return i, nil
+}
+
 // ParsePortRange parses and checks the provided range candidate to ensure it is
-// a valid TCP port range.
+// a valid TCP port range. Besides single ports and <lower>-<upper> ranges,
+// open-ended ranges are accepted as >=<lower> and <=<upper>.
 func ParsePortRange(portRange string) (PortRange, error) {
+	if lower, found := strings.CutPrefix(portRange, ">="); found {
+		return ParsePortRange(lower + "-" + strconv.Itoa(maxPort))
+	}
+	if upper, found := strings.CutPrefix(portRange, "<="); found {
+		return ParsePortRange("0-" + upper)
+	}
+
 	bounds := strings.Split(portRange, "-")
 	if len(bounds) > 2 {
 		return PortRange{}, fmt.Errorf("ranges expected as <lower>-<upper>")
@@ -51,3 +79,28 @@ func ParsePortRange(portRange string) (PortRange, error) {
 	}
 	return PortRange{LowerBound: lower, UpperBound: upper}, nil
 }
+
+// PortRangeFromSubnet is a port range only applying to the traffic coming
+// from a subnet.
+type PortRangeFromSubnet struct {
+	PortRange
+	Subnet *net.IPNet
+}
+
+// ParsePortRangeFromSubnet parses and checks the provided candidate, expected
+// as <port or range>@<subnet>, such as "4191@10.0.0.0/8".
+func ParsePortRangeFromSubnet(candidate string) (PortRangeFromSubnet, error) {
+	portRange, subnet, found := strings.Cut(candidate, "@")
+	if !found {
+		return PortRangeFromSubnet{}, fmt.Errorf("\"%s\": expected as <port or range>@<subnet>", candidate)
+	}
+	parsedRange, err := ParsePortRange(portRange)
+	if err != nil {
+		return PortRangeFromSubnet{}, err
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return PortRangeFromSubnet{}, fmt.Errorf("\"%s\" is not a valid CIDR address", subnet)
+	}
+	return PortRangeFromSubnet{PortRange: parsedRange, Subnet: ipNet}, nil
+}
@@ -35,6 +35,19 @@ func TestParsePort_Errors(t *testing.T) {
 	}
 }
 
+func TestParseProxyPort(t *testing.T) {
+	if port, err := ParseProxyPort("4143"); err != nil || port != 4143 {
+		t.Fatalf("expected 4143 but received %d (%v)", port, err)
+	}
+	for _, tt := range []string{"0", "-1", "65536", "proxy"} {
+		t.Run(tt, func(t *testing.T) {
+			if r, err := ParseProxyPort(tt); err == nil {
+				t.Fatalf("expected error but received %d", r)
+			}
+		})
+	}
+}
+
 func TestParsePortRange(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -44,6 +57,8 @@ func TestParsePortRange(t *testing.T) {
 		{"25-27", PortRange{LowerBound: 25, UpperBound: 27}},
 		{"0-65535", PortRange{LowerBound: 0, UpperBound: 65535}},
 		{"33", PortRange{LowerBound: 33, UpperBound: 33}},
+		{">=30000", PortRange{LowerBound: 30000, UpperBound: 65535}},
+		{"<=1024", PortRange{LowerBound: 0, UpperBound: 1024}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -69,6 +84,8 @@ func TestParsePortRange_Errors(t *testing.T) {
 		{"25-23", "upper-bound must be greater than or equal to"},
 		{"65536-65539", "not a valid lower-bound"},
 		{"23-notanumber", "not a valid upper-bound"},
+		{">=65536", "not a valid lower-bound"},
+		{"<=-1", "ranges expected as"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -78,6 +95,30 @@ func TestParsePortRange_Errors(t *testing.T) {
 	}
 }
 
+func TestParsePortRangeFromSubnet(t *testing.T) {
+	check, err := ParsePortRangeFromSubnet("4190-4191@10.1.2.3/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if check.PortRange != (PortRange{LowerBound: 4190, UpperBound: 4191}) || check.Subnet.String() != "10.0.0.0/8" {
+		t.Fatalf("unexpected port range from subnet %v %s", check.PortRange, check.Subnet)
+	}
+
+	for _, tt := range []struct {
+		input string
+		check string
+	}{
+		{"4191", "expected as <port or range>@<subnet>"},
+		{"notanumber@10.0.0.0/8", "not a valid lower-bound"},
+		{"4191@10.0.0.1", "not a valid CIDR address"},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParsePortRangeFromSubnet(tt.input)
+			assertError(t, err, tt.check)
+		})
+	}
+}
+
 // assertError confirms that the provided is an error having the provided message.
 func assertError(t *testing.T, err error, containing string) {
 	if err == nil {
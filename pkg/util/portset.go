@@ -0,0 +1,133 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PortSet is a set of TCP ports, held as sorted ranges that neither overlap
+// nor touch each other.
+type PortSet struct {
+	ranges []PortRange
+}
+
+// NewPortSet returns the set holding the ports of the provided ranges.
+func NewPortSet(ranges ...PortRange) PortSet {
+	return PortSet{ranges: mergePortRanges(ranges)}
+}
+
+// ParsePortSet parses the provided entries into a set. Each entry is a comma
+// separated list of ports and port ranges, as accepted by ParsePortRange.
+// Those prefixed with "!" are exclusions, removed from the set once all the
+// other ports are added, so that "1-65535,!4143,!4191" holds every port but
+// 4143 and 4191.
+func ParsePortSet(entries ...string) (PortSet, error) {
+	included := make([]PortRange, 0, len(entries))
+	excluded := make([]PortRange, 0)
+	for _, entry := range entries {
+		for _, token := range strings.Split(entry, ",") {
+			token = strings.TrimSpace(token)
+			exclusion, isExclusion := strings.CutPrefix(token, "!")
+			portRange, err := ParsePortRange(exclusion)
+			if err != nil {
+				return PortSet{}, err
+			}
+			if isExclusion {
+				excluded = append(excluded, portRange)
+			} else {
+				included = append(included, portRange)
+			}
+		}
+	}
+
+	return NewPortSet(included...).Without(NewPortSet(excluded...)), nil
+}
+
+// Ranges returns the minimal list of ranges holding the ports of the set, in
+// ascending order.
+func (s PortSet) Ranges() []PortRange {
+	return append([]PortRange{}, s.ranges...)
+}
+
+// IsEmpty returns whether the set holds no port.
+func (s PortSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+// Contains returns whether the port belongs to the set.
+func (s PortSet) Contains(port int) bool {
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].UpperBound >= port
+	})
+	return i < len(s.ranges) && s.ranges[i].LowerBound <= port
+}
+
+// Union returns the set holding the ports of both sets.
+func (s PortSet) Union(other PortSet) PortSet {
+	return NewPortSet(append(s.Ranges(), other.ranges...)...)
+}
+
+// Without returns the set holding the ports of s that don't belong to other.
+func (s PortSet) Without(other PortSet) PortSet {
+	ranges := make([]PortRange, 0, len(s.ranges))
+	for _, portRange := range s.ranges {
+		for _, excluded := range other.ranges {
+			if excluded.UpperBound < portRange.LowerBound || excluded.LowerBound > portRange.UpperBound {
+				continue
+			}
+			if excluded.LowerBound > portRange.LowerBound {
+				ranges = append(ranges, PortRange{LowerBound: portRange.LowerBound, UpperBound: excluded.LowerBound - 1})
+			}
+			portRange.LowerBound = excluded.UpperBound + 1
+			if portRange.LowerBound > portRange.UpperBound {
+				break
+			}
+		}
+		if portRange.LowerBound <= portRange.UpperBound {
+			ranges = append(ranges, portRange)
+		}
+	}
+	return PortSet{ranges: ranges}
+}
+
+// String renders the set as a comma separated list of ports and
+// <lower>-<upper> ranges, which ParsePortSet parses back.
+func (s PortSet) String() string {
+	entries := make([]string, 0, len(s.ranges))
+	for _, portRange := range s.ranges {
+		entries = append(entries, portRange.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+// String renders the range as a single port when both bounds are equal, and
+// as <lower>-<upper> otherwise.
+func (r PortRange) String() string {
+	if r.LowerBound == r.UpperBound {
+		return fmt.Sprintf("%d", r.LowerBound)
+	}
+	return fmt.Sprintf("%d-%d", r.LowerBound, r.UpperBound)
+}
+
+// mergePortRanges sorts the ranges, merging the ones overlapping or touching
+// each other.
+func mergePortRanges(ranges []PortRange) []PortRange {
+	sorted := append([]PortRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].LowerBound < sorted[j].LowerBound
+	})
+
+	merged := make([]PortRange, 0, len(sorted))
+	for _, portRange := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && portRange.LowerBound <= merged[last].UpperBound+1 {
+			if portRange.UpperBound > merged[last].UpperBound {
+				merged[last].UpperBound = portRange.UpperBound
+			}
+			continue
+		}
+		merged = append(merged, portRange)
+	}
+	return merged
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		expected []PortRange
+	}{
+		{"empty", []string{}, []PortRange{}},
+		{"sorted", []string{"33", "22", "25-27"}, []PortRange{{22, 22}, {25, 27}, {33, 33}}},
+		{"overlapping", []string{"25-27", "26-30", "27"}, []PortRange{{25, 30}}},
+		{"adjacent", []string{"25-27", "28", "29-30"}, []PortRange{{25, 30}}},
+		{"comma joined", []string{"22,25-27", " 33 "}, []PortRange{{22, 22}, {25, 27}, {33, 33}}},
+		{"open-ended", []string{">=30000", "<=1024"}, []PortRange{{0, 1024}, {30000, 65535}}},
+		{"exclusions", []string{"1-65535,!4143,!4191"}, []PortRange{{1, 4142}, {4144, 4190}, {4192, 65535}}},
+		{"exclusions across entries", []string{"!4190-4191", "4000-5000"}, []PortRange{{4000, 4189}, {4192, 5000}}},
+		{"excluded bounds", []string{"25-30", "!25", "!30"}, []PortRange{{26, 29}}},
+		{"excluded entirely", []string{"25-30", "!20-40"}, []PortRange{}},
+		{"exclusions only", []string{"!4143"}, []PortRange{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portSet, err := ParsePortSet(tt.input...)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(tt.expected, portSet.Ranges()) {
+				t.Fatalf("expected ranges %v but got %v", tt.expected, portSet.Ranges())
+			}
+		})
+	}
+}
+
+func TestParsePortSet_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		check string
+	}{
+		{"22,notanumber", "not a valid lower-bound"},
+		{"22,", "not a valid lower-bound"},
+		{"!25-23", "upper-bound must be greater than or equal to"},
+		{"!!25", "not a valid lower-bound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParsePortSet(tt.input)
+			assertError(t, err, tt.check)
+		})
+	}
+}
+
+func TestPortSet_Contains(t *testing.T) {
+	portSet, _ := ParsePortSet("22", "25-27", ">=30000", "!30080")
+	for port, expected := range map[int]bool{
+		0:     false,
+		22:    true,
+		23:    false,
+		25:    true,
+		26:    true,
+		27:    true,
+		29999: false,
+		30000: true,
+		30080: false,
+		65535: true,
+	} {
+		if portSet.Contains(port) != expected {
+			t.Errorf("expected Contains(%d) to be %t", port, expected)
+		}
+	}
+}
+
+func TestPortSet_String(t *testing.T) {
+	portSet := NewPortSet(PortRange{30, 30}, PortRange{22, 23}, PortRange{24, 25})
+	if portSet.String() != "22-25,30" {
+		t.Fatalf("expected \"22-25,30\" but got %q", portSet.String())
+	}
+
+	parsed, err := ParsePortSet(portSet.String())
+	if err != nil || !reflect.DeepEqual(parsed, portSet) {
+		t.Fatalf("expected %q to parse back, got %v (%v)", portSet, parsed, err)
+	}
+
+	if !NewPortSet().IsEmpty() || NewPortSet().String() != "" {
+		t.Fatal("expected the empty set to render as an empty string")
+	}
+}
+
+func TestPortSet_Union(t *testing.T) {
+	a, _ := ParsePortSet("22-25")
+	b, _ := ParsePortSet("26", "30")
+	if union := a.Union(b); union.String() != "22-26,30" {
+		t.Fatalf("expected \"22-26,30\" but got %q", union)
+	}
+}
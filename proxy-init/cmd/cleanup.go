@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+	"github.com/linkerd/linkerd2-proxy-init/pkg/util"
+)
+
+func newCmdCleanup(options *RootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove the firewall rules installed by proxy-init",
+		Long: `Remove the firewall rules installed by proxy-init.
+
+The proxy-init chains and the jumps to them are removed, optionally inside
+--netns, for IPv4 and, unless --ipv6=false, for IPv6. Rules already removed
+are skipped, so it is safe to run on a partially configured network namespace.`,
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if err := configureLogging(options); err != nil {
+				return err
+			}
+
+			return forEachFirewallConfiguration(cleanupOptions(options), iptables.CleanupFirewallConfig)
+		},
+	}
+}
+
+// cleanupOptions returns a copy of the options where the proxy ports, which
+// play no part in removing the rules, are valid even when not provided.
+func cleanupOptions(options *RootOptions) *RootOptions {
+	opts := *options
+	if !util.IsValidProxyPort(opts.IncomingProxyPort) {
+		opts.IncomingProxyPort = 1
+	}
+	if !util.IsValidProxyPort(opts.OutgoingProxyPort) {
+		opts.OutgoingProxyPort = 1
+	}
+	return &opts
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestCleanupOptions(t *testing.T) {
+	options := newRootOptions()
+	options.IPTablesMode = IPTablesModeNFT
+	options.NetNs = "/var/run/netns/test"
+
+	config, err := BuildFirewallConfiguration(cleanupOptions(options))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if config.NetNs != options.NetNs || config.BinPath != "ip6tables-nft" {
+		t.Fatalf("Unexpected config [%+v]", config)
+	}
+
+	if options.IncomingProxyPort != -1 || options.OutgoingProxyPort != -1 {
+		t.Fatalf("Expected the options to be left untouched, got [%+v]", options)
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileFlag is the flag pointing to the configuration file, which can't
+// be set from the file itself.
+const configFileFlag = "config"
+
+// cniOnlyKeys are the keys of the CNI plugin "linkerd" configuration which
+// only drive the plugin, and are ignored so that it can be passed as is.
+var cniOnlyKeys = map[string]bool{
+	"merge-policy": true,
+}
+
+// loadConfigFile applies the values of the YAML or JSON configuration file to
+// the flags of the command. Keys are flag names, which also match the fields
+// of the CNI plugin "linkerd" configuration. Values are parsed as if they were
+// passed on the command line, and only applied to the flags not explicitly
+// set, so flags take precedence over the file.
+func loadConfigFile(cmd *cobra.Command, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if cniOnlyKeys[key] {
+			log.Debugf("ignoring config file key %s, only used by the CNI plugin", key)
+			continue
+		}
+
+		flag := lookupFlag(cmd, key)
+		if flag == nil || key == configFileFlag || key == "help" {
+			if key != configFileFlag && cmd.Root().LocalNonPersistentFlags().Lookup(key) != nil {
+				// a flag of the root command only, not relevant to this subcommand
+				log.Debugf("ignoring config file key %s, not supported by %s", key, cmd.Name())
+				continue
+			}
+			return fmt.Errorf("unknown key %q in config file %s", key, path)
+		}
+
+		if flag.Changed {
+			continue
+		}
+
+		value, err := configValue(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for key %q in config file %s: %w", key, path, err)
+		}
+
+		if err := setFlag(flag, value); err != nil {
+			return fmt.Errorf("invalid value for key %q in config file %s: %w", key, path, err)
+		}
+	}
+
+	return nil
+}
+
+// configValue renders a configuration file value the way it would be passed
+// on the command line, joining lists with commas.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("expected a scalar or a list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// lookupFlag returns the flag of the command with the provided name, be it
+// local or inherited from its parents.
+func lookupFlag(cmd *cobra.Command, name string) *pflag.Flag {
+	if flag := cmd.Flags().Lookup(name); flag != nil {
+		return flag
+	}
+	if flag := cmd.PersistentFlags().Lookup(name); flag != nil {
+		return flag
+	}
+	return cmd.InheritedFlags().Lookup(name)
+}
+
+// setFlag sets the flag from its command line representation. Unlike
+// repeating the flag, setting a list replaces its default value.
+func setFlag(flag *pflag.Flag, value string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok && value == "" {
+		if err := slice.Replace([]string{}); err != nil {
+			return err
+		}
+	} else if err := flag.Value.Set(value); err != nil {
+		return err
+	}
+
+	flag.Changed = true
+	return nil
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	writeConfig := func(t *testing.T, name string, content string) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return path
+	}
+
+	t.Run("It applies YAML values, with flags taking precedence", func(t *testing.T) {
+		path := writeConfig(t, "config.yaml", `
+incoming-proxy-port: 4143
+outgoing-proxy-port: 4140
+proxy-uid: 2102
+inbound-ports-to-ignore: ["4190", "4191"]
+subnets-to-ignore: []
+ipv6: false
+iptables-mode: nft
+`)
+		cmd := NewRootCmd()
+		if err := cmd.ParseFlags([]string{"--config", path, "--proxy-uid", "1000"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := loadConfigFile(cmd, path); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		flags := cmd.Flags()
+		if port, _ := flags.GetInt("incoming-proxy-port"); port != 4143 {
+			t.Fatalf("Expected incoming-proxy-port 4143, got %d", port)
+		}
+		if uid, _ := flags.GetInt("proxy-uid"); uid != 1000 {
+			t.Fatalf("Expected the proxy-uid flag to take precedence, got %d", uid)
+		}
+		if ports, _ := flags.GetStringSlice("inbound-ports-to-ignore"); !reflect.DeepEqual(ports, []string{"4190", "4191"}) {
+			t.Fatalf("Unexpected inbound-ports-to-ignore %v", ports)
+		}
+		if ipv6, _ := flags.GetBool("ipv6"); ipv6 {
+			t.Fatal("Expected ipv6 to be disabled")
+		}
+	})
+
+	t.Run("It accepts the CNI plugin JSON shape", func(t *testing.T) {
+		path := writeConfig(t, "config.json", `{
+  "incoming-proxy-port": 4143,
+  "outgoing-proxy-port": 4140,
+  "ports-to-redirect": [8080, 8081],
+  "simulate": true,
+  "merge-policy": {"outbound-ports-to-ignore": "append"}
+}`)
+		cmd := NewRootCmd()
+		if err := cmd.ParseFlags([]string{}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := loadConfigFile(cmd, path); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if ports, _ := cmd.Flags().GetIntSlice("ports-to-redirect"); !reflect.DeepEqual(ports, []int{8080, 8081}) {
+			t.Fatalf("Unexpected ports-to-redirect %v", ports)
+		}
+	})
+
+	t.Run("It ignores root command keys in subcommands", func(t *testing.T) {
+		path := writeConfig(t, "config.yaml", "simulate-output: json\nincoming-proxy-port: 4143")
+		root := NewRootCmd()
+		verify, _, err := root.Find([]string{"verify"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := loadConfigFile(verify, path); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if port, _ := verify.Flags().GetInt("incoming-proxy-port"); port != 4143 {
+			t.Fatalf("Expected incoming-proxy-port 4143, got %d", port)
+		}
+	})
+
+	t.Run("It rejects invalid files", func(t *testing.T) {
+		for _, tt := range []struct {
+			content      string
+			errorMessage string
+		}{
+			{
+				content:      "incoming-proxy-prot: 4143",
+				errorMessage: `unknown key "incoming-proxy-prot" in config file %s`,
+			},
+			{
+				content:      "config: other.yaml",
+				errorMessage: `unknown key "config" in config file %s`,
+			},
+			{
+				content:      "incoming-proxy-port: abc",
+				errorMessage: `invalid value for key "incoming-proxy-port" in config file %s: strconv.ParseInt: parsing "abc": invalid syntax`,
+			},
+			{
+				content:      "subnets-to-ignore: {a: b}",
+				errorMessage: `invalid value for key "subnets-to-ignore" in config file %s: expected a scalar or a list`,
+			},
+		} {
+			path := writeConfig(t, "config.yaml", tt.content)
+			err := loadConfigFile(NewRootCmd(), path)
+			if err == nil || err.Error() != fmt.Sprintf(tt.errorMessage, path) {
+				t.Fatalf("Expected error [%s], got [%v]", fmt.Sprintf(tt.errorMessage, path), err)
+			}
+		}
+	})
+}
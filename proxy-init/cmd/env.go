@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix prefixes the environment variables setting the flags.
+const envPrefix = "LINKERD_PROXY_INIT_"
+
+// envName returns the environment variable setting the flag, e.g.
+// LINKERD_PROXY_INIT_INCOMING_PROXY_PORT for --incoming-proxy-port.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// documentEnv appends the environment variable of each flag to its usage.
+func documentEnv(flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		flag.Usage = fmt.Sprintf("%s [$%s]", flag.Usage, envName(flag.Name))
+	})
+}
+
+// loadEnv applies the environment variables to the flags of the command not
+// explicitly set, so flags take precedence over the environment. Values are
+// parsed as if they were passed on the command line.
+func loadEnv(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(flag.Name))
+		if !ok {
+			return
+		}
+
+		if setErr := setFlag(flag, value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s: %w", envName(flag.Name), setErr)
+		}
+	})
+	return err
+}
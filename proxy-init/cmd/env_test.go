@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadEnv(t *testing.T) {
+	t.Run("It applies environment variables, with flags taking precedence", func(t *testing.T) {
+		t.Setenv("LINKERD_PROXY_INIT_INCOMING_PROXY_PORT", "4143")
+		t.Setenv("LINKERD_PROXY_INIT_PROXY_UID", "2102")
+		t.Setenv("LINKERD_PROXY_INIT_SUBNETS_TO_IGNORE", "10.0.0.0/8,192.168.0.0/16")
+		t.Setenv("LINKERD_PROXY_INIT_IPV6", "false")
+
+		cmd := NewRootCmd()
+		if err := cmd.ParseFlags([]string{"-u", "1000"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := loadEnv(cmd); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		flags := cmd.Flags()
+		if port, _ := flags.GetInt("incoming-proxy-port"); port != 4143 {
+			t.Fatalf("Expected incoming-proxy-port 4143, got %d", port)
+		}
+		if uid, _ := flags.GetInt("proxy-uid"); uid != 1000 {
+			t.Fatalf("Expected the proxy-uid flag to take precedence, got %d", uid)
+		}
+		if subnets, _ := flags.GetStringSlice("subnets-to-ignore"); !reflect.DeepEqual(subnets, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+			t.Fatalf("Unexpected subnets-to-ignore %v", subnets)
+		}
+		if ipv6, _ := flags.GetBool("ipv6"); ipv6 {
+			t.Fatal("Expected ipv6 to be disabled")
+		}
+	})
+
+	t.Run("It takes precedence over the config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte("incoming-proxy-port: 1\noutgoing-proxy-port: 4140\n"), 0o600); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		t.Setenv("LINKERD_PROXY_INIT_CONFIG", path)
+		t.Setenv("LINKERD_PROXY_INIT_INCOMING_PROXY_PORT", "4143")
+
+		cmd := NewRootCmd()
+		if err := cmd.ParseFlags([]string{}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := cmd.PersistentPreRunE(cmd, nil); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if port, _ := cmd.Flags().GetInt("incoming-proxy-port"); port != 4143 {
+			t.Fatalf("Expected incoming-proxy-port 4143, got %d", port)
+		}
+		if port, _ := cmd.Flags().GetInt("outgoing-proxy-port"); port != 4140 {
+			t.Fatalf("Expected outgoing-proxy-port 4140, got %d", port)
+		}
+	})
+
+	t.Run("It rejects invalid values", func(t *testing.T) {
+		t.Setenv("LINKERD_PROXY_INIT_OUTGOING_PROXY_PORT", "abc")
+
+		cmd := NewRootCmd()
+		if err := cmd.ParseFlags([]string{}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		err := loadEnv(cmd)
+		if err == nil || err.Error() != `invalid value for LINKERD_PROXY_INIT_OUTGOING_PROXY_PORT: strconv.ParseInt: parsing "abc": invalid syntax` {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+}
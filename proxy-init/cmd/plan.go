@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+)
+
+const (
+	// SimulateOutputLog logs the commands that would be executed
+	SimulateOutputLog = "log"
+	// SimulateOutputJSON prints the plan of every IP family as a JSON array
+	SimulateOutputJSON = "json"
+	// SimulateOutputRestore prints the plan of every IP family as
+	// iptables-restore payloads
+	SimulateOutputRestore = "restore"
+)
+
+func validateSimulateOutput(options *RootOptions) error {
+	switch options.SimulateOutput {
+	case "", SimulateOutputLog, SimulateOutputJSON, SimulateOutputRestore:
+		return nil
+	default:
+		return fmt.Errorf("--simulate-output valid values are only \"%s\", \"%s\" and \"%s\"", SimulateOutputLog, SimulateOutputJSON, SimulateOutputRestore)
+	}
+}
+
+// writePlans writes the plan of every IP family enabled by the options to w,
+// in the format selected by --simulate-output.
+func writePlans(options *RootOptions, w io.Writer) error {
+	plans := make([]*iptables.Plan, 0)
+	err := forEachFirewallConfiguration(options, func(config iptables.FirewallConfiguration) error {
+		plans = append(plans, iptables.NewPlan(config))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if options.SimulateOutput == SimulateOutputJSON {
+		out, err := json.MarshalIndent(plans, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	}
+
+	for _, plan := range plans {
+		if _, err := io.WriteString(w, plan.RestoreText()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+)
+
+func TestWritePlans(t *testing.T) {
+	t.Run("It writes a JSON plan for both IP families", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 4143
+		options.OutgoingProxyPort = 4140
+		options.SimulateOnly = true
+		options.SimulateOutput = SimulateOutputJSON
+
+		var out bytes.Buffer
+		if err := writePlans(options, &out); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		plans := []iptables.Plan{}
+		if err := json.Unmarshal(out.Bytes(), &plans); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(plans) != 2 || plans[0].Family != iptables.FamilyIPv4 || plans[1].Family != iptables.FamilyIPv6 {
+			t.Fatalf("Expected IPv4 and IPv6 plans, got %+v", plans)
+		}
+	})
+
+	t.Run("It partitions the subnets by IP family", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 4143
+		options.OutgoingProxyPort = 4140
+		options.SubnetsToIgnore = []string{"10.0.0.0/8", "fd00::/8"}
+		options.OutboundSubnetsToIgnore = []string{"169.254.169.254/32"}
+		options.SimulateOnly = true
+		options.SimulateOutput = SimulateOutputJSON
+
+		var out bytes.Buffer
+		if err := writePlans(options, &out); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		plans := []iptables.Plan{}
+		if err := json.Unmarshal(out.Bytes(), &plans); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(plans[0].SubnetsToIgnore, []string{"10.0.0.0/8"}) || !reflect.DeepEqual(plans[0].OutboundSubnetsToIgnore, []string{"169.254.169.254/32"}) {
+			t.Fatalf("Unexpected IPv4 subnets in %+v", plans[0])
+		}
+		if !reflect.DeepEqual(plans[1].SubnetsToIgnore, []string{"fd00::/8"}) || len(plans[1].OutboundSubnetsToIgnore) != 0 {
+			t.Fatalf("Unexpected IPv6 subnets in %+v", plans[1])
+		}
+	})
+
+	t.Run("It rejects IPv6 subnets when IPv6 is disabled", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 4143
+		options.OutgoingProxyPort = 4140
+		options.IPv6 = false
+		options.OutboundSubnetsToIgnore = []string{"fd00::/8"}
+		options.SimulateOnly = true
+		options.SimulateOutput = SimulateOutputJSON
+
+		err := writePlans(options, &bytes.Buffer{})
+		if err == nil || err.Error() != "fd00::/8 is an IPv6 subnet but --ipv6 is disabled" {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("It rejects unknown formats", func(t *testing.T) {
+		options := newRootOptions()
+		options.SimulateOutput = "yaml"
+
+		err := validateSimulateOutput(options)
+		if err == nil || err.Error() != "--simulate-output valid values are only \"log\", \"json\" and \"restore\"" {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+}
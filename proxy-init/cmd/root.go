@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -21,6 +24,9 @@ const (
 	// IPTablesModePlain signals the usage of the iptables commands, which
 	// can be either legacy or nft
 	IPTablesModePlain = "plain"
+	// IPTablesModeNFTables signals the usage of nftables through netlink,
+	// without relying on any external binary
+	IPTablesModeNFTables = "nftables"
 
 	cmdLegacy         = "iptables-legacy"
 	cmdLegacySave     = "iptables-legacy-save"
@@ -38,46 +44,66 @@ const (
 
 // RootOptions provides the information that will be used to build a firewall configuration.
 type RootOptions struct {
-	IncomingProxyPort     int
-	OutgoingProxyPort     int
-	ProxyUserID           int
-	ProxyGroupID          int
-	PortsToRedirect       []int
-	InboundPortsToIgnore  []string
-	OutboundPortsToIgnore []string
-	SubnetsToIgnore       []string
-	SimulateOnly          bool
-	NetNs                 string
-	UseWaitFlag           bool
-	TimeoutCloseWaitSecs  int
-	LogFormat             string
-	LogLevel              string
-	FirewallBinPath       string
-	FirewallSaveBinPath   string
-	IPTablesMode          string
-	IPv6                  bool
+	IncomingProxyPort               int
+	OutgoingProxyPort               int
+	ProxyUserID                     int
+	ProxyGroupID                    int
+	ProxyCgroupPath                 string
+	ProxyMark                       int
+	PortsToRedirect                 []int
+	InboundPortsToIgnore            []string
+	InboundPortsToIgnoreFromSubnets []string
+	OutboundPortsToIgnore           []string
+	SubnetsToIgnore                 []string
+	OutboundSubnetsToIgnore         []string
+	UseSets                         bool
+	LenientPortValidation           bool
+	SimulateOnly                    bool
+	NetNs                           string
+	UseWaitFlag                     bool
+	TimeoutCloseWaitSecs            int
+	LogFormat                       string
+	LogLevel                        string
+	FirewallBinPath                 string
+	FirewallSaveBinPath             string
+	IPTablesMode                    string
+	IPv6                            bool
+	OutboundDNSProxyPort            int
+	InboundInterception             string
+	SimulateOutput                  string
+	ConfigFile                      string
 }
 
 func newRootOptions() *RootOptions {
 	return &RootOptions{
-		IncomingProxyPort:     -1,
-		OutgoingProxyPort:     -1,
-		ProxyUserID:           -1,
-		ProxyGroupID:          -1,
-		PortsToRedirect:       make([]int, 0),
-		InboundPortsToIgnore:  make([]string, 0),
-		OutboundPortsToIgnore: make([]string, 0),
-		SubnetsToIgnore:       make([]string, 0),
-		SimulateOnly:          false,
-		NetNs:                 "",
-		UseWaitFlag:           false,
-		TimeoutCloseWaitSecs:  0,
-		LogFormat:             "plain",
-		LogLevel:              "info",
-		FirewallBinPath:       "",
-		FirewallSaveBinPath:   "",
-		IPTablesMode:          "",
-		IPv6:                  true,
+		IncomingProxyPort:               -1,
+		OutgoingProxyPort:               -1,
+		ProxyUserID:                     -1,
+		ProxyGroupID:                    -1,
+		ProxyCgroupPath:                 "",
+		ProxyMark:                       0,
+		PortsToRedirect:                 make([]int, 0),
+		InboundPortsToIgnore:            make([]string, 0),
+		InboundPortsToIgnoreFromSubnets: make([]string, 0),
+		OutboundPortsToIgnore:           make([]string, 0),
+		SubnetsToIgnore:                 make([]string, 0),
+		OutboundSubnetsToIgnore:         make([]string, 0),
+		UseSets:                         false,
+		LenientPortValidation:           false,
+		SimulateOnly:                    false,
+		NetNs:                           "",
+		UseWaitFlag:                     false,
+		TimeoutCloseWaitSecs:            0,
+		LogFormat:                       "plain",
+		LogLevel:                        "info",
+		FirewallBinPath:                 "",
+		FirewallSaveBinPath:             "",
+		IPTablesMode:                    "",
+		IPv6:                            true,
+		OutboundDNSProxyPort:            0,
+		InboundInterception:             iptables.InboundInterceptionModeRedirect,
+		SimulateOutput:                  SimulateOutputLog,
+		ConfigFile:                      "",
 	}
 }
 
@@ -89,8 +115,26 @@ func NewRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "proxy-init",
 		Short: "proxy-init adds a Kubernetes pod to the Linkerd service mesh",
-		Long:  "proxy-init adds a Kubernetes pod to the Linkerd service mesh.",
-		RunE: func(_ *cobra.Command, _ []string) error {
+		Long: `proxy-init adds a Kubernetes pod to the Linkerd service mesh.
+
+Every flag can also be set through the environment variable listed in its
+description, or through the file passed to --config. Flags take precedence
+over environment variables, which take precedence over the config file.`,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			if err := loadEnv(cmd); err != nil {
+				return err
+			}
+
+			if options.ConfigFile == "" {
+				return nil
+			}
+
+			return loadConfigFile(cmd, options.ConfigFile)
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := validateSimulateOutput(options); err != nil {
+				return err
+			}
 
 			if options.TimeoutCloseWaitSecs != 0 {
 				sysctl := exec.Command("sysctl", "-w",
@@ -104,69 +148,63 @@ func NewRootCmd() *cobra.Command {
 				log.Info(string(out))
 			}
 
-			log.SetFormatter(getFormatter(options.LogFormat))
-			err := setLogLevel(options.LogLevel)
-			if err != nil {
-				return err
-			}
-
-			// always trigger the IPv4 rules
-			optIPv4 := *options
-			optIPv4.IPv6 = false
-			config, err := BuildFirewallConfiguration(&optIPv4)
-			if err != nil {
-				return err
-			}
-
-			if err = iptables.ConfigureFirewall(*config); err != nil {
+			if err := configureLogging(options); err != nil {
 				return err
 			}
 
-			if !options.IPv6 {
-				return nil
-			}
-
-			// trigger the IPv6 rules
-			config, err = BuildFirewallConfiguration(options)
-			if err != nil {
-				return err
+			if options.SimulateOnly && options.SimulateOutput != SimulateOutputLog {
+				// keep stdout for the plan only
+				log.SetOutput(os.Stderr)
+				return writePlans(options, cmd.OutOrStdout())
 			}
 
-			if err = iptables.ConfigureFirewall(*config); err != nil {
-				return err
-			}
-
-			return nil
+			return forEachFirewallConfiguration(options, iptables.ConfigureFirewall)
 		},
 	}
 
+	cmd.AddCommand(newCmdVerify(options))
+	cmd.AddCommand(newCmdCleanup(options))
+
+	cmd.PersistentFlags().StringVar(&options.ConfigFile, configFileFlag, options.ConfigFile, "Optional YAML or JSON file holding the values of any of the other flags, keyed by flag name; flags take precedence over the file")
 	cmd.PersistentFlags().IntVarP(&options.IncomingProxyPort, "incoming-proxy-port", "p", options.IncomingProxyPort, "Port to redirect incoming traffic")
 	cmd.PersistentFlags().IntVarP(&options.OutgoingProxyPort, "outgoing-proxy-port", "o", options.OutgoingProxyPort, "Port to redirect outgoing traffic")
 	cmd.PersistentFlags().IntVarP(&options.ProxyUserID, "proxy-uid", "u", options.ProxyUserID, "User ID that the proxy is running under. Any traffic coming from this user will be ignored to avoid infinite redirection loops.")
 	cmd.PersistentFlags().IntVarP(&options.ProxyGroupID, "proxy-gid", "g", options.ProxyGroupID, "Group ID that the proxy is running under. Any traffic coming from this group will be ignored to avoid infinite redirection loops.")
+	cmd.PersistentFlags().StringVar(&options.ProxyCgroupPath, "proxy-cgroup-path", options.ProxyCgroupPath, "Cgroup v2 path of the proxy, relative to the cgroup root. Any traffic coming from this cgroup will be ignored to avoid infinite redirection loops, even when workloads run under the proxy user. The cgroup must already exist when the rules are installed, such as the one of a proxy running as a node service, so it can't be the cgroup of a proxy container, and it isn't supported by linkerd-cni: use --proxy-mark for those.")
+	cmd.PersistentFlags().IntVar(&options.ProxyMark, "proxy-mark", options.ProxyMark, "Fwmark the proxy sets through SO_MARK on the outbound connections that must not be redirected back to it; disabled when 0")
 	cmd.PersistentFlags().IntSliceVarP(&options.PortsToRedirect, "ports-to-redirect", "r", options.PortsToRedirect, "Port to redirect to proxy, if no port is specified then ALL ports are redirected")
-	cmd.PersistentFlags().StringSliceVar(&options.InboundPortsToIgnore, "inbound-ports-to-ignore", options.InboundPortsToIgnore, "Inbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
-	cmd.PersistentFlags().StringSliceVar(&options.OutboundPortsToIgnore, "outbound-ports-to-ignore", options.OutboundPortsToIgnore, "Outbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
+	cmd.PersistentFlags().StringSliceVar(&options.InboundPortsToIgnore, "inbound-ports-to-ignore", options.InboundPortsToIgnore, "Inbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. Open-ended ranges (>=30000) and exclusions (!4143) are accepted. This has higher precedence than any other parameters.")
+	cmd.PersistentFlags().StringSliceVar(&options.InboundPortsToIgnoreFromSubnets, "inbound-ports-to-ignore-from-subnets", options.InboundPortsToIgnoreFromSubnets, "Inbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy only for the traffic coming from a subnet, as <port or range>@<subnet> (e.g. 4191@10.0.0.0/8)")
+	cmd.PersistentFlags().StringSliceVar(&options.OutboundPortsToIgnore, "outbound-ports-to-ignore", options.OutboundPortsToIgnore, "Outbound ports and/or port ranges (inclusive) to ignore and not redirect to proxy. Open-ended ranges (>=30000) and exclusions (!4143) are accepted. This has higher precedence than any other parameters.")
 	cmd.PersistentFlags().StringSliceVar(&options.SubnetsToIgnore, "subnets-to-ignore", options.SubnetsToIgnore, "Subnets to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
+	cmd.PersistentFlags().StringSliceVar(&options.OutboundSubnetsToIgnore, "outbound-subnets-to-ignore", options.OutboundSubnetsToIgnore, "Destination subnets of outbound traffic to ignore and not redirect to proxy. This has higher precedence than any other parameters.")
+	cmd.PersistentFlags().BoolVar(&options.UseSets, "use-sets", options.UseSets, "Hold the ports and subnets to ignore in ipsets, which requires the ipset binary, or nftables sets in nftables mode, matched by a single rule per chain")
+	cmd.PersistentFlags().BoolVar(&options.LenientPortValidation, "lenient-port-validation", options.LenientPortValidation, "Log and skip the invalid entries of the port lists instead of failing, as earlier versions did")
 	cmd.PersistentFlags().BoolVar(&options.SimulateOnly, "simulate", options.SimulateOnly, "Don't execute any command, just print what would be executed")
+	cmd.Flags().StringVar(&options.SimulateOutput, "simulate-output", options.SimulateOutput, "Output of --simulate: \"log\" logs the commands, while \"json\" and \"restore\" print the plan of every IP family to stdout as JSON or iptables-restore payloads")
 	cmd.PersistentFlags().StringVar(&options.NetNs, "netns", options.NetNs, "Optional network namespace in which to run the iptables commands")
 	cmd.PersistentFlags().BoolVarP(&options.UseWaitFlag, "use-wait-flag", "w", options.UseWaitFlag, "Appends the \"-w\" flag to the iptables commands")
 	cmd.PersistentFlags().IntVar(&options.TimeoutCloseWaitSecs, "timeout-close-wait-secs", options.TimeoutCloseWaitSecs, "Sets nf_conntrack_tcp_timeout_close_wait")
 	cmd.PersistentFlags().StringVar(&options.LogFormat, "log-format", options.LogFormat, "Configure log format ('plain' or 'json')")
 	cmd.PersistentFlags().StringVar(&options.LogLevel, "log-level", options.LogLevel, "Configure log level")
-	cmd.PersistentFlags().StringVar(&options.IPTablesMode, "iptables-mode", options.IPTablesMode, "Variant of iptables command to use (\"legacy\", \"nft\" or \"plain\"); overrides --firewall-bin-path and --firewall-save-bin-path")
+	cmd.PersistentFlags().StringVar(&options.IPTablesMode, "iptables-mode", options.IPTablesMode, "Variant of iptables command to use (\"legacy\", \"nft\", \"plain\" or \"nftables\"); overrides --firewall-bin-path and --firewall-save-bin-path")
 	cmd.PersistentFlags().BoolVar(&options.IPv6, "ipv6", options.IPv6, "Set rules both via iptables and ip6tables to support dual-stack networking")
+	cmd.PersistentFlags().StringVar(&options.InboundInterception, "inbound-interception-mode", options.InboundInterception, "How inbound traffic is delivered to the proxy: \"redirect\" rewrites its destination, while \"tproxy\" preserves it")
+	cmd.PersistentFlags().IntVar(&options.OutboundDNSProxyPort, "outbound-dns-proxy-port", options.OutboundDNSProxyPort, "Port to redirect outgoing DNS traffic (UDP and TCP port 53) to; disabled when 0")
 
 	// these two flags are kept for backwards-compatibility, but --iptables-mode is preferred
 	cmd.PersistentFlags().StringVar(&options.FirewallBinPath, "firewall-bin-path", options.FirewallBinPath, "Path to iptables binary")
 	cmd.PersistentFlags().StringVar(&options.FirewallSaveBinPath, "firewall-save-bin-path", options.FirewallSaveBinPath, "Path to iptables-save binary")
+
+	documentEnv(cmd.PersistentFlags())
+	documentEnv(cmd.Flags())
 	return cmd
 }
 
 // BuildFirewallConfiguration returns an iptables FirewallConfiguration suitable to use to configure iptables.
 func BuildFirewallConfiguration(options *RootOptions) (*iptables.FirewallConfiguration, error) {
-	if options.IPTablesMode != "" && options.IPTablesMode != IPTablesModeLegacy && options.IPTablesMode != IPTablesModeNFT && options.IPTablesMode != IPTablesModePlain {
-		return nil, fmt.Errorf("--iptables-mode valid values are only \"%s\", \"%s\" and \"%s\"", IPTablesModeLegacy, IPTablesModeNFT, IPTablesModePlain)
+	if options.IPTablesMode != "" && options.IPTablesMode != IPTablesModeLegacy && options.IPTablesMode != IPTablesModeNFT && options.IPTablesMode != IPTablesModePlain && options.IPTablesMode != IPTablesModeNFTables {
+		return nil, fmt.Errorf("--iptables-mode valid values are only \"%s\", \"%s\", \"%s\" and \"%s\"", IPTablesModeLegacy, IPTablesModeNFT, IPTablesModePlain, IPTablesModeNFTables)
 	}
 
 	if options.IPTablesMode == "" {
@@ -182,18 +220,227 @@ func BuildFirewallConfiguration(options *RootOptions) (*iptables.FirewallConfigu
 		}
 	}
 
-	if !util.IsValidPort(options.IncomingProxyPort) {
+	if !util.IsValidProxyPort(options.IncomingProxyPort) {
 		return nil, fmt.Errorf("--incoming-proxy-port must be a valid TCP port number")
 	}
 
-	if !util.IsValidPort(options.OutgoingProxyPort) {
+	if !util.IsValidProxyPort(options.OutgoingProxyPort) {
 		return nil, fmt.Errorf("--outgoing-proxy-port must be a valid TCP port number")
 	}
 
+	if options.InboundInterception != "" && options.InboundInterception != iptables.InboundInterceptionModeRedirect && options.InboundInterception != iptables.InboundInterceptionModeTProxy {
+		return nil, fmt.Errorf("--inbound-interception-mode valid values are only \"%s\" and \"%s\"", iptables.InboundInterceptionModeRedirect, iptables.InboundInterceptionModeTProxy)
+	}
+
+	// 0 disables the DNS redirection
+	if !util.IsValidPort(options.OutboundDNSProxyPort) {
+		return nil, fmt.Errorf("--outbound-dns-proxy-port must be a valid port number")
+	}
+
+	if options.ProxyMark < 0 || int64(options.ProxyMark) > math.MaxUint32 {
+		return nil, fmt.Errorf("--proxy-mark must be a valid 32-bit fwmark")
+	}
+
+	if options.ProxyMark == iptables.DefaultTProxyMark && options.InboundInterception == iptables.InboundInterceptionModeTProxy {
+		return nil, fmt.Errorf("--proxy-mark must differ from the TPROXY mark 0x%x", iptables.DefaultTProxyMark)
+	}
+
 	cmd, cmdSave := getCommands(options)
 
+	inboundPortsToIgnore, inboundErr := sanitizePorts("inbound-ports-to-ignore", options.InboundPortsToIgnore, options.LenientPortValidation)
+	outboundPortsToIgnore, outboundErr := sanitizePorts("outbound-ports-to-ignore", options.OutboundPortsToIgnore, options.LenientPortValidation)
+	portsToRedirect, redirectErr := sanitizePortsToRedirect(options.PortsToRedirect, options.LenientPortValidation)
+	sanitizedPortsFromSubnets, fromSubnetsErr := sanitizePortsFromSubnets(options.InboundPortsToIgnoreFromSubnets, options.LenientPortValidation)
+	if err := errors.Join(inboundErr, outboundErr, redirectErr, fromSubnetsErr); err != nil {
+		return nil, err
+	}
+
+	sanitizedSubnets, err := sanitizeSubnets(options.SubnetsToIgnore)
+	if err != nil {
+		return nil, err
+	}
+
+	sanitizedOutboundSubnets, err := sanitizeSubnets(options.OutboundSubnetsToIgnore)
+	if err != nil {
+		return nil, err
+	}
+
+	// the iptables modes are invoked once per IP family, and the subnets of
+	// the other family would be rejected
+	if options.IPTablesMode != IPTablesModeNFTables {
+		family := iptables.FamilyIPv4
+		if options.IPv6 {
+			family = iptables.FamilyIPv6
+		}
+
+		sanitizedSubnets = filterSubnets(sanitizedSubnets, options.IPv6)
+		sanitizedOutboundSubnets = filterSubnets(sanitizedOutboundSubnets, options.IPv6)
+		sanitizedPortsFromSubnets = filterPortsFromSubnets(sanitizedPortsFromSubnets, options.IPv6)
+		log.Debugf("%s subnets to ignore: inbound %v, outbound %v, inbound ports %v", family, sanitizedSubnets, sanitizedOutboundSubnets, sanitizedPortsFromSubnets)
+	}
+
+	firewallConfiguration := &iptables.FirewallConfiguration{
+		ProxyInboundPort:                options.IncomingProxyPort,
+		ProxyOutgoingPort:               options.OutgoingProxyPort,
+		ProxyUID:                        options.ProxyUserID,
+		ProxyGID:                        options.ProxyGroupID,
+		ProxyCgroupPath:                 strings.TrimSpace(options.ProxyCgroupPath),
+		ProxyMark:                       options.ProxyMark,
+		PortsToRedirectInbound:          portsToRedirect,
+		InboundPortsToIgnore:            inboundPortsToIgnore,
+		InboundPortsToIgnoreFromSubnets: sanitizedPortsFromSubnets,
+		OutboundPortsToIgnore:           outboundPortsToIgnore,
+		SubnetsToIgnore:                 sanitizedSubnets,
+		OutboundSubnetsToIgnore:         sanitizedOutboundSubnets,
+		UseSets:                         options.UseSets,
+		SimulateOnly:                    options.SimulateOnly,
+		NetNs:                           options.NetNs,
+		UseWaitFlag:                     options.UseWaitFlag,
+		BinPath:                         cmd,
+		SaveBinPath:                     cmdSave,
+		NFTables:                        options.IPTablesMode == IPTablesModeNFTables,
+		IPv6:                            options.IPv6,
+		ProxyOutboundDNSPort:            options.OutboundDNSProxyPort,
+		InboundInterceptionMode:         options.InboundInterception,
+	}
+
+	if len(portsToRedirect) > 0 {
+		firewallConfiguration.Mode = iptables.RedirectListedMode
+	} else {
+		firewallConfiguration.Mode = iptables.RedirectAllMode
+	}
+
+	return firewallConfiguration, nil
+}
+
+// ValidateSubnetFamilies makes sure the subnets to ignore can be handled by
+// one of the IP families the rules are installed for, that is that no IPv6
+// subnet is provided when IPv6 is disabled.
+func ValidateSubnetFamilies(options *RootOptions) error {
+	if options.IPv6 {
+		return nil
+	}
+
+	portsFromSubnets := make([]string, 0, len(options.InboundPortsToIgnoreFromSubnets))
+	for _, candidate := range options.InboundPortsToIgnoreFromSubnets {
+		_, subnet, _ := strings.Cut(candidate, "@")
+		portsFromSubnets = append(portsFromSubnets, subnet)
+	}
+
+	for _, subnets := range [][]string{options.SubnetsToIgnore, options.OutboundSubnetsToIgnore, portsFromSubnets} {
+		for _, subnet := range subnets {
+			subnet := strings.TrimSpace(subnet)
+			if ip, _, err := net.ParseCIDR(subnet); err == nil && ip.To4() == nil {
+				return fmt.Errorf("%s is an IPv6 subnet but --ipv6 is disabled", subnet)
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterSubnets returns the subnets of the IP family, IPv6 or IPv4. The
+// subnets must be valid.
+func filterSubnets(subnets []string, ipv6 bool) []string {
+	filtered := []string{}
+	for _, subnet := range subnets {
+		ip, _, _ := net.ParseCIDR(subnet)
+		if (ip.To4() == nil) == ipv6 {
+			filtered = append(filtered, subnet)
+		}
+	}
+
+	return filtered
+}
+
+// sanitizePorts trims the ports and port ranges of the flag, returning the
+// valid ones. Every invalid entry is reported, unless lenient is set in which
+// case they are logged and skipped.
+func sanitizePorts(flag string, ports []string, lenient bool) ([]string, error) {
+	sanitized := []string{}
+	errs := []error{}
+	for _, port := range ports {
+		port := strings.TrimSpace(port)
+		if _, err := util.ParsePortSet(port); err != nil {
+			err = fmt.Errorf("--%s: invalid entry %q: %w", flag, port, err)
+			if lenient {
+				log.Warnf("skipping %s", err)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		sanitized = append(sanitized, port)
+	}
+
+	return sanitized, errors.Join(errs...)
+}
+
+// sanitizePortsToRedirect returns the valid ports to redirect, reporting the
+// invalid ones like sanitizePorts.
+func sanitizePortsToRedirect(ports []int, lenient bool) ([]int, error) {
+	sanitized := []int{}
+	errs := []error{}
+	for _, port := range ports {
+		if !util.IsValidPort(port) {
+			err := fmt.Errorf("--ports-to-redirect: invalid entry %d: not a valid TCP port", port)
+			if lenient {
+				log.Warnf("skipping %s", err)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		sanitized = append(sanitized, port)
+	}
+
+	return sanitized, errors.Join(errs...)
+}
+
+// sanitizePortsFromSubnets returns the valid ports to ignore from a subnet,
+// trimmed, reporting the invalid ones like sanitizePorts.
+func sanitizePortsFromSubnets(candidates []string, lenient bool) ([]string, error) {
+	sanitized := []string{}
+	errs := []error{}
+	for _, candidate := range candidates {
+		candidate := strings.TrimSpace(candidate)
+		if _, err := util.ParsePortRangeFromSubnet(candidate); err != nil {
+			err = fmt.Errorf("--inbound-ports-to-ignore-from-subnets: invalid entry %q: %w", candidate, err)
+			if lenient {
+				log.Warnf("skipping %s", err)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		sanitized = append(sanitized, candidate)
+	}
+
+	return sanitized, errors.Join(errs...)
+}
+
+// filterPortsFromSubnets returns the ports to ignore from a subnet of the IP
+// family, IPv6 or IPv4. They must be valid.
+func filterPortsFromSubnets(candidates []string, ipv6 bool) []string {
+	filtered := []string{}
+	for _, candidate := range candidates {
+		parsed, _ := util.ParsePortRangeFromSubnet(candidate)
+		if (parsed.Subnet.IP.To4() == nil) == ipv6 {
+			filtered = append(filtered, candidate)
+		}
+	}
+
+	return filtered
+}
+
+// sanitizeSubnets trims the subnets, making sure they are valid CIDR
+// addresses.
+func sanitizeSubnets(subnets []string) ([]string, error) {
 	sanitizedSubnets := []string{}
-	for _, subnet := range options.SubnetsToIgnore {
+	for _, subnet := range subnets {
 		subnet := strings.TrimSpace(subnet)
 		_, _, err := net.ParseCIDR(subnet)
 		if err != nil {
@@ -203,29 +450,56 @@ func BuildFirewallConfiguration(options *RootOptions) (*iptables.FirewallConfigu
 		sanitizedSubnets = append(sanitizedSubnets, subnet)
 	}
 
-	firewallConfiguration := &iptables.FirewallConfiguration{
-		ProxyInboundPort:       options.IncomingProxyPort,
-		ProxyOutgoingPort:      options.OutgoingProxyPort,
-		ProxyUID:               options.ProxyUserID,
-		ProxyGID:               options.ProxyGroupID,
-		PortsToRedirectInbound: options.PortsToRedirect,
-		InboundPortsToIgnore:   options.InboundPortsToIgnore,
-		OutboundPortsToIgnore:  options.OutboundPortsToIgnore,
-		SubnetsToIgnore:        sanitizedSubnets,
-		SimulateOnly:           options.SimulateOnly,
-		NetNs:                  options.NetNs,
-		UseWaitFlag:            options.UseWaitFlag,
-		BinPath:                cmd,
-		SaveBinPath:            cmdSave,
-	}
-
-	if len(options.PortsToRedirect) > 0 {
-		firewallConfiguration.Mode = iptables.RedirectListedMode
-	} else {
-		firewallConfiguration.Mode = iptables.RedirectAllMode
+	return sanitizedSubnets, nil
+}
+
+// forEachFirewallConfiguration calls fn with the firewall configuration of
+// every IP family enabled by the options: the IPv4 one first, followed by the
+// IPv6 one when --ipv6 is set. In nftables mode a single configuration handles
+// both families.
+func forEachFirewallConfiguration(options *RootOptions, fn func(iptables.FirewallConfiguration) error) error {
+	if err := ValidateSubnetFamilies(options); err != nil {
+		return err
 	}
 
-	return firewallConfiguration, nil
+	// nftables handles both IPv4 and IPv6 from a single inet table
+	if options.IPTablesMode == IPTablesModeNFTables {
+		config, err := BuildFirewallConfiguration(options)
+		if err != nil {
+			return err
+		}
+
+		return fn(*config)
+	}
+
+	// always trigger the IPv4 rules
+	optIPv4 := *options
+	optIPv4.IPv6 = false
+	config, err := BuildFirewallConfiguration(&optIPv4)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(*config); err != nil {
+		return err
+	}
+
+	if !options.IPv6 {
+		return nil
+	}
+
+	// trigger the IPv6 rules
+	config, err = BuildFirewallConfiguration(options)
+	if err != nil {
+		return err
+	}
+
+	return fn(*config)
+}
+
+func configureLogging(options *RootOptions) error {
+	log.SetFormatter(getFormatter(options.LogFormat))
+	return setLogLevel(options.LogLevel)
 }
 
 func getFormatter(format string) log.Formatter {
@@ -239,6 +513,9 @@ func getFormatter(format string) log.Formatter {
 
 func getCommands(options *RootOptions) (string, string) {
 	switch options.IPTablesMode {
+	case IPTablesModeNFTables:
+		// no binaries are involved when talking to nftables over netlink
+		return "", ""
 	case IPTablesModeLegacy:
 		if options.IPv6 {
 			return cmdLegacyIPv6, cmdLegacyIPv6Save
@@ -14,19 +14,22 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 		expectedProxyUserID := 33
 		expectedProxyGroupID := 33
 		expectedConfig := &iptables.FirewallConfiguration{
-			Mode:                   iptables.RedirectAllMode,
-			PortsToRedirectInbound: make([]int, 0),
-			InboundPortsToIgnore:   make([]string, 0),
-			OutboundPortsToIgnore:  make([]string, 0),
-			SubnetsToIgnore:        make([]string, 0),
-			ProxyInboundPort:       expectedIncomingProxyPort,
-			ProxyOutgoingPort:      expectedOutgoingProxyPort,
-			ProxyUID:               expectedProxyUserID,
-			ProxyGID:               expectedProxyGroupID,
-			SimulateOnly:           false,
-			UseWaitFlag:            false,
-			BinPath:                "iptables-legacy",
-			SaveBinPath:            "iptables-legacy-save",
+			Mode:                            iptables.RedirectAllMode,
+			PortsToRedirectInbound:          make([]int, 0),
+			InboundPortsToIgnore:            make([]string, 0),
+			InboundPortsToIgnoreFromSubnets: make([]string, 0),
+			OutboundPortsToIgnore:           make([]string, 0),
+			SubnetsToIgnore:                 make([]string, 0),
+			OutboundSubnetsToIgnore:         make([]string, 0),
+			ProxyInboundPort:                expectedIncomingProxyPort,
+			ProxyOutgoingPort:               expectedOutgoingProxyPort,
+			ProxyUID:                        expectedProxyUserID,
+			ProxyGID:                        expectedProxyGroupID,
+			SimulateOnly:                    false,
+			UseWaitFlag:                     false,
+			BinPath:                         "iptables-legacy",
+			SaveBinPath:                     "iptables-legacy-save",
+			InboundInterceptionMode:         iptables.InboundInterceptionModeRedirect,
 		}
 
 		options := newRootOptions()
@@ -46,6 +49,86 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 		}
 	})
 
+	t.Run("It produces a FirewallConfiguration for the nftables mode", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 1234
+		options.OutgoingProxyPort = 2345
+		options.IPTablesMode = IPTablesModeNFTables
+
+		config, err := BuildFirewallConfiguration(options)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if !config.NFTables || !config.IPv6 {
+			t.Fatalf("Expected an nftables config handling IPv6, got [%+v]", config)
+		}
+
+		if config.BinPath != "" || config.SaveBinPath != "" {
+			t.Fatalf("Expected no iptables binaries, got [%s] and [%s]", config.BinPath, config.SaveBinPath)
+		}
+	})
+
+	t.Run("It keeps the ports to ignore from a subnet of the IP family", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 1234
+		options.OutgoingProxyPort = 2345
+		options.InboundPortsToIgnoreFromSubnets = []string{"4191@10.0.0.0/8", " 4190-4191@fd00::/8"}
+
+		config, err := BuildFirewallConfiguration(options)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if !reflect.DeepEqual(config.InboundPortsToIgnoreFromSubnets, []string{"4190-4191@fd00::/8"}) {
+			t.Fatalf("Unexpected ports to ignore from subnets %v", config.InboundPortsToIgnoreFromSubnets)
+		}
+	})
+
+	t.Run("It reports every invalid port entry", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 1234
+		options.OutgoingProxyPort = 2345
+		options.InboundPortsToIgnore = []string{"4190", "metrics", "25-23"}
+		options.OutboundPortsToIgnore = []string{"443", "70000"}
+		options.PortsToRedirect = []int{8080, -1}
+		options.InboundPortsToIgnoreFromSubnets = []string{"4191@10.0.0.0/8", "4192", "70000@10.0.0.0/8"}
+
+		_, err := BuildFirewallConfiguration(options)
+		expected := `--inbound-ports-to-ignore: invalid entry "metrics": "metrics" is not a valid lower-bound
+--inbound-ports-to-ignore: invalid entry "25-23": "25-23": upper-bound must be greater than or equal to lower-bound
+--outbound-ports-to-ignore: invalid entry "70000": "70000" is not a valid lower-bound
+--ports-to-redirect: invalid entry -1: not a valid TCP port
+--inbound-ports-to-ignore-from-subnets: invalid entry "4192": "4192": expected as <port or range>@<subnet>
+--inbound-ports-to-ignore-from-subnets: invalid entry "70000@10.0.0.0/8": "70000" is not a valid lower-bound`
+		if err == nil || err.Error() != expected {
+			t.Fatalf("Expected error \n[%s]\n but got \n[%v]", expected, err)
+		}
+	})
+
+	t.Run("It skips invalid port entries when lenient", func(t *testing.T) {
+		options := newRootOptions()
+		options.IncomingProxyPort = 1234
+		options.OutgoingProxyPort = 2345
+		options.InboundPortsToIgnore = []string{"4190", "metrics"}
+		options.PortsToRedirect = []int{-1}
+		options.InboundPortsToIgnoreFromSubnets = []string{"4191@fd00::/8", "4192"}
+		options.LenientPortValidation = true
+
+		config, err := BuildFirewallConfiguration(options)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if !reflect.DeepEqual(config.InboundPortsToIgnoreFromSubnets, []string{"4191@fd00::/8"}) {
+			t.Fatalf("Unexpected ports to ignore from subnets %v", config.InboundPortsToIgnoreFromSubnets)
+		}
+
+		if !reflect.DeepEqual(config.InboundPortsToIgnore, []string{"4190"}) || len(config.PortsToRedirectInbound) != 0 || config.Mode != iptables.RedirectAllMode {
+			t.Fatalf("Unexpected config [%+v]", config)
+		}
+	})
+
 	t.Run("It rejects invalid config options", func(t *testing.T) {
 		for _, tt := range []struct {
 			options      *RootOptions
@@ -67,6 +150,22 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 				},
 				errorMessage: "--incoming-proxy-port must be a valid TCP port number",
 			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 0,
+					OutgoingProxyPort: 1234,
+					IPTablesMode:      IPTablesModeLegacy,
+				},
+				errorMessage: "--incoming-proxy-port must be a valid TCP port number",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 0,
+					IPTablesMode:      IPTablesModeLegacy,
+				},
+				errorMessage: "--outgoing-proxy-port must be a valid TCP port number",
+			},
 			{
 				options: &RootOptions{
 					IncomingProxyPort: 1234,
@@ -85,8 +184,71 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 			},
 			{
 				options: &RootOptions{
-					SubnetsToIgnore: []string{"1.1.1.1/24", "0.0.0.0"},
-					IPTablesMode:    IPTablesModeLegacy,
+					IncomingProxyPort:    1234,
+					OutgoingProxyPort:    2345,
+					OutboundDNSProxyPort: 100000,
+					IPTablesMode:         IPTablesModeLegacy,
+				},
+				errorMessage: "--outbound-dns-proxy-port must be a valid port number",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:   1234,
+					OutgoingProxyPort:   2345,
+					InboundInterception: "tproxi",
+					IPTablesMode:        IPTablesModeLegacy,
+				},
+				errorMessage: "--inbound-interception-mode valid values are only \"redirect\" and \"tproxy\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					ProxyMark:         -1,
+					IPTablesMode:      IPTablesModeLegacy,
+				},
+				errorMessage: "--proxy-mark must be a valid 32-bit fwmark",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:   1234,
+					OutgoingProxyPort:   2345,
+					ProxyMark:           0x539,
+					InboundInterception: "tproxy",
+					IPTablesMode:        IPTablesModeLegacy,
+				},
+				errorMessage: "--proxy-mark must differ from the TPROXY mark 0x539",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:       1234,
+					OutgoingProxyPort:       2345,
+					OutboundSubnetsToIgnore: []string{"169.254.169.254"},
+					IPTablesMode:            IPTablesModeLegacy,
+				},
+				errorMessage: "169.254.169.254 is not a valid CIDR address",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort:               1234,
+					OutgoingProxyPort:               2345,
+					InboundPortsToIgnoreFromSubnets: []string{"4191"},
+					IPTablesMode:                    IPTablesModeLegacy,
+				},
+				errorMessage: "--inbound-ports-to-ignore-from-subnets: invalid entry \"4191\": \"4191\": expected as <port or range>@<subnet>",
+			},
+			{
+				options: &RootOptions{
+					IPTablesMode: "nftable",
+				},
+				errorMessage: "--iptables-mode valid values are only \"legacy\", \"nft\", \"plain\" and \"nftables\"",
+			},
+			{
+				options: &RootOptions{
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					SubnetsToIgnore:   []string{"1.1.1.1/24", "0.0.0.0"},
+					IPTablesMode:      IPTablesModeLegacy,
 				},
 				errorMessage: "0.0.0.0 is not a valid CIDR address",
 			},
@@ -110,8 +272,10 @@ func TestBuildFirewallConfiguration(t *testing.T) {
 			{
 				// Tests that subnets are parsed properly and trimmed of excess whitespace
 				options: &RootOptions{
-					SubnetsToIgnore: []string{"1.1.1.1/24 "},
-					IPTablesMode:    IPTablesModeLegacy,
+					IncomingProxyPort: 1234,
+					OutgoingProxyPort: 2345,
+					SubnetsToIgnore:   []string{"1.1.1.1/24 "},
+					IPTablesMode:      IPTablesModeLegacy,
 				},
 				errorMessage: "",
 			},
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+)
+
+func newCmdVerify(options *RootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the installed firewall rules match the configuration",
+		Long: `Verify the installed firewall rules match the configuration.
+
+The current rules, optionally inside --netns, are compared against the ones
+proxy-init would install given the same flags. Missing, extra and reordered
+rules in the proxy-init chains and their jumps are reported, and the command
+exits with a non-zero status if any is found.`,
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if err := configureLogging(options); err != nil {
+				return err
+			}
+
+			return runVerify(options, iptables.VerifyFirewall)
+		},
+	}
+}
+
+func runVerify(options *RootOptions, verify func(iptables.FirewallConfiguration) ([]iptables.Drift, error)) error {
+	drifts := 0
+	err := forEachFirewallConfiguration(options, func(config iptables.FirewallConfiguration) error {
+		found, err := verify(config)
+		if err != nil {
+			return err
+		}
+
+		for _, drift := range found {
+			log.Error(drift.String())
+		}
+		drifts += len(found)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if drifts > 0 {
+		return fmt.Errorf("found %d differences between the installed and the expected firewall rules", drifts)
+	}
+
+	log.Info("installed firewall rules match the expected configuration")
+	return nil
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/linkerd/linkerd2-proxy-init/pkg/iptables"
+)
+
+func TestRunVerify(t *testing.T) {
+	newOptions := func() *RootOptions {
+		options := newRootOptions()
+		options.IncomingProxyPort = 4143
+		options.OutgoingProxyPort = 4140
+		return options
+	}
+
+	t.Run("It verifies both IP families", func(t *testing.T) {
+		bins := []string{}
+		err := runVerify(newOptions(), func(config iptables.FirewallConfiguration) ([]iptables.Drift, error) {
+			bins = append(bins, config.BinPath)
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(bins) != 2 || bins[0] != "iptables-legacy" || bins[1] != "ip6tables-legacy" {
+			t.Fatalf("Expected IPv4 and IPv6 passes, got %v", bins)
+		}
+	})
+
+	t.Run("It fails on drift", func(t *testing.T) {
+		err := runVerify(newOptions(), func(config iptables.FirewallConfiguration) ([]iptables.Drift, error) {
+			return []iptables.Drift{{Table: "nat", Chain: "PROXY_INIT_OUTPUT", Kind: iptables.DriftMissing, Rule: "-A PROXY_INIT_OUTPUT -j RETURN"}}, nil
+		})
+		if err == nil || err.Error() != "found 2 differences between the installed and the expected firewall rules" {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+}